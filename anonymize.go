@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ways the anonymize command can rewrite IPs
+const (
+	anonIPTruncate = "truncate"
+	anonIPHMAC     = "hmac"
+	anonIPKeep     = "keep"
+)
+
+var anonIPModes = []string{anonIPTruncate, anonIPHMAC, anonIPKeep}
+
+// redacted replaces whatever was removed from a line
+const redacted = "REDACTED"
+
+// defaultRedactParams are the query parameters that commonly carry credentials or session identifiers
+var defaultRedactParams = []string{
+	"access_token", "api_key", "apikey", "auth", "code", "id_token", "key", "password", "passwd", "refresh_token",
+	"secret", "session", "sessionid", "sid", "sig", "signature", "token",
+}
+
+var (
+	anonIPPattern    = regexp.MustCompile(`(?:[0-9A-Fa-f]{0,4}:){2,7}[0-9A-Fa-f.]*|\d{1,3}(?:\.\d{1,3}){3}`)
+	anonEmailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+(?:@|%40)[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+	anonTokenPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*|AKIA[0-9A-Z]{16}|(?i:bearer)(?:\s+|%20|\+)[A-Za-z0-9._~+/=-]+`)
+)
+
+// anonymizer rewrites the personal data out of log lines, changing nothing else about them
+type anonymizer struct {
+	ipMode         string
+	key            []byte
+	v4Bits, v6Bits int
+	params         *regexp.Regexp
+	emails         bool
+	tokens         bool
+}
+
+func newAnonymizer() *anonymizer {
+	return &anonymizer{}
+}
+
+// loadKey reads the HMAC key from file, ignoring surrounding whitespace
+func (a *anonymizer) loadKey(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	a.key = []byte(strings.TrimSpace(string(data)))
+	if len(a.key) == 0 {
+		return fmt.Errorf("%s: empty key", file)
+	}
+	return nil
+}
+
+// setParams sets the comma-separated query parameters whose values are redacted
+func (a *anonymizer) setParams(params string) {
+	var names []string
+	for _, p := range strings.Split(params, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			names = append(names, regexp.QuoteMeta(p))
+		}
+	}
+	if len(names) == 0 {
+		a.params = nil
+		return
+	}
+	a.params = regexp.MustCompile(`(?i)([?&;](?:` + strings.Join(names, "|") + `)=)[^&;#\s"]*`)
+}
+
+// rewrite returns ll.Raw with the values in ll's spans anonymized
+func (a *anonymizer) rewrite(ll *LogLine) string {
+	spans := append([]span(nil), ll.spans...)
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	var b strings.Builder
+	last := 0
+	for _, s := range spans {
+		if s.start < last || s.end > len(ll.Raw) {
+			continue
+		}
+		b.WriteString(ll.Raw[last:s.start])
+		b.WriteString(a.value(s.valueType, ll.Raw[s.start:s.end]))
+		last = s.end
+	}
+	b.WriteString(ll.Raw[last:])
+	return b.String()
+}
+
+// value anonymizes the raw text of one value
+func (a *anonymizer) value(valueType string, text string) string {
+	switch valueType {
+	case ValueIP, ValueForwardedFor, ValueHAProxyRequestHeaders, ValueHAProxyResponseHeaders:
+		return a.ipsIn(a.text(text))
+	case ValueHAProxyClient:
+		// HAProxy doesn't bracket IPv6 addresses, so split off the port before the generic pattern sees it
+		if i := strings.LastIndex(text, ":"); i >= 0 {
+			if _, err := strconv.Atoi(text[i+1:]); err == nil {
+				return a.ipsIn(text[:i]) + text[i:]
+			}
+		}
+		return a.ipsIn(text)
+	case ValueRequest, ValueReferer, ValueURIStem, ValueURIQuery:
+		return a.url(text)
+	case ValueErrorMessage:
+		return a.ipsIn(a.url(text))
+	case ValueUser:
+		return a.text(text)
+	}
+	return text
+}
+
+// url redacts the configured query parameters, then anything text would
+func (a *anonymizer) url(text string) string {
+	if a.params != nil {
+		text = a.params.ReplaceAllString(text, "${1}"+redacted)
+	}
+	return a.text(text)
+}
+
+// text redacts email addresses and tokens
+func (a *anonymizer) text(text string) string {
+	if a.emails {
+		text = anonEmailPattern.ReplaceAllString(text, redacted)
+	}
+	if a.tokens {
+		text = anonTokenPattern.ReplaceAllString(text, redacted)
+	}
+	return text
+}
+
+// ipsIn rewrites every IP address in text
+func (a *anonymizer) ipsIn(text string) string {
+	if a.ipMode == anonIPKeep {
+		return text
+	}
+	return anonIPPattern.ReplaceAllStringFunc(text, func(match string) string {
+		ip := net.ParseIP(match)
+		if ip == nil {
+			return match
+		}
+		return a.ip(ip).String()
+	})
+}
+
+// ip truncates ip to its network, or replaces it with a keyed pseudonym: the same address always gets the
+// same pseudonym under the same key, so files anonymized separately can still be correlated. Pseudonyms
+// come from 240.0.0.0/4 and fd00::/8 so they can't be mistaken for real, routable addresses.
+func (a *anonymizer) ip(ip net.IP) net.IP {
+	ip4 := ip.To4()
+	switch a.ipMode {
+	case anonIPTruncate:
+		if ip4 != nil {
+			return ip4.Mask(net.CIDRMask(a.v4Bits, 32))
+		}
+		return ip.Mask(net.CIDRMask(a.v6Bits, 128))
+	case anonIPHMAC:
+		mac := hmac.New(sha256.New, a.key)
+		if ip4 != nil {
+			mac.Write(ip4)
+			sum := mac.Sum(nil)
+			return net.IPv4(0xf0|sum[0]&0x0f, sum[1], sum[2], sum[3]).To4()
+		}
+		mac.Write(ip.To16())
+		sum := mac.Sum(nil)
+		result := make(net.IP, net.IPv6len)
+		result[0] = 0xfd
+		copy(result[1:], sum[:15])
+		return result
+	}
+	return ip
+}
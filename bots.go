@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// bot classes, from most to least trustworthy
+const (
+	botVerified = "verified"
+	botClaimed  = "claimed"
+	botGeneric  = "bot"
+	botHuman    = "human"
+)
+
+var botClasses = []string{botVerified, botClaimed, botGeneric, botHuman}
+
+// crawler is a well-known search engine or platform crawler that can be verified
+type crawler struct {
+	name    string
+	ua      *regexp.Regexp
+	domains []string // reverse DNS names of genuine crawler IPs end in one of these
+}
+
+var crawlers = []*crawler{
+	// not googleusercontent.com: every Google Cloud VM's reverse DNS is under it
+	{"Googlebot", regexp.MustCompile(`(?i)googlebot|google-inspectiontool|googleother|adsbot-google|mediapartners-google|apis-google|storebot-google`), []string{".googlebot.com", ".google.com"}},
+	{"Bingbot", regexp.MustCompile(`(?i)bingbot|msnbot|bingpreview|adidxbot`), []string{".search.msn.com"}},
+	{"Applebot", regexp.MustCompile(`(?i)applebot`), []string{".applebot.apple.com"}},
+	{"DuckDuckBot", regexp.MustCompile(`(?i)duckduckbot|duckassistbot`), []string{".duckduckgo.com"}},
+	{"YandexBot", regexp.MustCompile(`(?i)yandex(bot|images|mobilebot|metrika|webmaster|accessibilitybot)`), []string{".yandex.ru", ".yandex.net", ".yandex.com"}},
+	{"Baiduspider", regexp.MustCompile(`(?i)baiduspider`), []string{".crawl.baidu.com", ".crawl.baidu.jp"}},
+	{"Yahoo! Slurp", regexp.MustCompile(`(?i)yahoo! slurp`), []string{".crawl.yahoo.net"}},
+	{"Facebook", regexp.MustCompile(`(?i)facebookexternalhit|facebookcatalog|meta-externalagent`), nil},
+	{"GPTBot", regexp.MustCompile(`(?i)gptbot|oai-searchbot|chatgpt-user`), nil},
+}
+
+// genericBotUA matches user agents of crawlers, scripts and libraries that don't pretend to be browsers
+var genericBotUA = regexp.MustCompile(`(?i)bot\b|bot/|crawl|spider|slurp|scrap|fetch|monitor|checker|preview|` +
+	`curl/|wget/|python-|python/|aiohttp|go-http-client|java/|okhttp|libwww|lwp::|perl/|php/|ruby|node-fetch|axios/|` +
+	`httpclient|http_request|headlesschrome|phantomjs|masscan|zgrab|nmap|nikto|sqlmap|nuclei`)
+
+// botClassifier sorts lines into botClasses, remembering its answer for each IP and user agent
+type botClassifier struct {
+	ranges     map[string][]*net.IPNet // crawler name to published ranges; "" applies to every crawler
+	dns        bool
+	dnsTimeout time.Duration
+	resolver   *net.Resolver
+	verified   map[string]bool // crawler name + IP to whether it checked out
+}
+
+func newBotClassifier() *botClassifier {
+	return &botClassifier{
+		ranges:   map[string][]*net.IPNet{},
+		resolver: net.DefaultResolver,
+		verified: map[string]bool{},
+	}
+}
+
+// loadRanges reads "name=file" or "file" specs; files are either lists of IPs and CIDRs or JSON documents
+// like the ones Google and Bing publish, with a "prefixes" list of {"ipv4Prefix": ...} objects
+func (b *botClassifier) loadRanges(specs []string) error {
+	for _, spec := range specs {
+		name, file := "", spec
+		if i := strings.IndexRune(spec, '='); i >= 0 {
+			name, file = spec[:i], spec[i+1:]
+			if findCrawler(name) == nil {
+				return fmt.Errorf("unknown crawler: %s", name)
+			}
+			name = findCrawler(name).name
+		}
+		nets, err := readCrawlerRanges(file)
+		if err != nil {
+			return err
+		}
+		b.ranges[name] = append(b.ranges[name], nets...)
+	}
+	return nil
+}
+
+// findCrawler returns the crawler called name, ignoring case
+func findCrawler(name string) *crawler {
+	for _, c := range crawlers {
+		if strings.EqualFold(c.name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+func readCrawlerRanges(file string) ([]*net.IPNet, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		return readNetList(file)
+	}
+
+	var doc struct {
+		Prefixes []map[string]string `json:"prefixes"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	var result []*net.IPNet
+	for _, prefix := range doc.Prefixes {
+		for _, v := range prefix {
+			ipNet, err := parseIPOrCIDR(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			result = append(result, ipNet)
+		}
+	}
+	return result, nil
+}
+
+// classify returns ll's class and, for crawlers, which one it claims to be
+func (b *botClassifier) classify(ll *LogLine) (class string, name string) {
+	ua := ll.UserAgent
+	for _, c := range crawlers {
+		if !c.ua.MatchString(ua) {
+			continue
+		}
+		if ll.IP != nil && b.verify(c, ll.IP) {
+			return botVerified, c.name
+		}
+		return botClaimed, c.name
+	}
+	if ua == "" || ua == "-" || genericBotUA.MatchString(ua) {
+		return botGeneric, ""
+	}
+	return botHuman, ""
+}
+
+// verify checks ip against c's published ranges and, if enabled, forward-confirmed reverse DNS
+func (b *botClassifier) verify(c *crawler, ip net.IP) bool {
+	if inNets(ip, b.ranges[c.name]) || inNets(ip, b.ranges[""]) {
+		return true
+	}
+	if !b.dns || len(c.domains) == 0 {
+		return false
+	}
+
+	key := c.name + " " + ip.String()
+	if ok, seen := b.verified[key]; seen {
+		return ok
+	}
+	ok := b.fcrdns(c, ip)
+	b.verified[key] = ok
+	return ok
+}
+
+// fcrdns looks up ip's hostnames, and accepts one in c's domains that resolves back to ip
+func (b *botClassifier) fcrdns(c *crawler, ip net.IP) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), b.dnsTimeout)
+	defer cancel()
+
+	names, err := b.resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return false
+	}
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if !hasDomainSuffix(name, c.domains) {
+			continue
+		}
+		addrs, err := b.resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasDomainSuffix(host string, domains []string) bool {
+	for _, d := range domains {
+		if strings.HasSuffix(host, d) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// failRule decides whether a response counts as a failed login: a status, optionally only when the body
+// was smaller than some size (e.g. a 200 that re-rendered the login form)
+type failRule struct {
+	status   int64
+	maxBytes int64 // 0 means any size
+}
+
+// parseFailRules parses "401,403,200<512"
+func parseFailRules(input string) ([]failRule, error) {
+	var rules []failRule
+	for _, part := range strings.Split(input, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		rule := failRule{}
+		status := part
+		if i := strings.IndexRune(part, '<'); i >= 0 {
+			max, err := strconv.ParseInt(part[i+1:], 10, 64)
+			if err != nil || max <= 0 {
+				return nil, fmt.Errorf("invalid body size in %s", part)
+			}
+			status, rule.maxBytes = part[:i], max
+		}
+		s, err := strconv.ParseInt(status, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status in %s", part)
+		}
+		rule.status = s
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no failure statuses given")
+	}
+	return rules, nil
+}
+
+func (f failRule) matches(ll *LogLine) bool {
+	return ll.Status == f.status && (f.maxBytes == 0 || ll.BodyBytes < f.maxBytes)
+}
+
+// pathMatcher matches request paths exactly, or by prefix when the pattern ends in '*'
+type pathMatcher []string
+
+func (p pathMatcher) matches(path string) bool {
+	for _, pattern := range p {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(path, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if path == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// subnetOf returns the network containing ip, using v4Bits or v6Bits of prefix as appropriate
+func subnetOf(ip net.IP, v4Bits int, v6Bits int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(v4Bits, 32)), Mask: net.CIDRMask(v4Bits, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(v6Bits, 128)), Mask: net.CIDRMask(v6Bits, 128)}).String()
+}
+
+// bruteforceDetector tracks failed logins per IP and per subnet over a sliding window of log time
+type bruteforceDetector struct {
+	paths           pathMatcher
+	method          string
+	fails           []failRule
+	window          time.Duration
+	threshold       int
+	subnetThreshold int
+	v4Bits, v6Bits  int
+
+	ips      *slidingWindow
+	subnets  *slidingWindow
+	overall  *slidingWindow
+	alerting map[string]bool
+
+	total   int
+	peak    int
+	peakAt  time.Time
+	summary map[string]*subnetFailures
+}
+
+// subnetFailures accumulates a subnet's failures for the summary
+type subnetFailures struct {
+	subnet   string
+	failures int
+	peak     int
+	ips      map[string]int // each IP's most failures within one window
+	alerted  bool
+}
+
+func newBruteforceDetector() *bruteforceDetector {
+	return &bruteforceDetector{
+		alerting: map[string]bool{},
+		summary:  map[string]*subnetFailures{},
+	}
+}
+
+// start prepares the windows once the options are known
+func (b *bruteforceDetector) start() {
+	b.ips = newSlidingWindow(b.window)
+	b.subnets = newSlidingWindow(b.window)
+	b.overall = newSlidingWindow(b.window)
+}
+
+func (b *bruteforceDetector) isFailure(ll *LogLine) bool {
+	if ll.Request == nil || ll.Request.URL == nil || ll.IP == nil {
+		return false
+	}
+	if b.method != "" && !strings.EqualFold(ll.Request.Method, b.method) {
+		return false
+	}
+	if !b.paths.matches(ll.Request.URL.Path) {
+		return false
+	}
+	for _, f := range b.fails {
+		if f.matches(ll) {
+			return true
+		}
+	}
+	return false
+}
+
+// add processes a line, writing an alert to w whenever an IP or subnet crosses its threshold
+func (b *bruteforceDetector) add(w io.Writer, ll *LogLine) {
+	if !b.isFailure(ll) {
+		return
+	}
+
+	ip := ll.IP.String()
+	subnet := subnetOf(ll.IP, b.v4Bits, b.v6Bits)
+
+	b.total++
+	if n := b.overall.add("", ll.Time); n > b.peak {
+		b.peak, b.peakAt = n, b.overall.latest
+	}
+
+	s, ok := b.summary[subnet]
+	if !ok {
+		s = &subnetFailures{subnet: subnet, ips: map[string]int{}}
+		b.summary[subnet] = s
+	}
+	s.failures++
+
+	ipCount := b.ips.add(ip, ll.Time)
+	if ipCount > s.ips[ip] {
+		s.ips[ip] = ipCount
+	}
+	if b.crossed("ip "+ip, ipCount, b.threshold) {
+		fmt.Fprintf(w, "%s ALERT ip %s: %d failures in %s\n", ll.Time.Format(time.RFC3339), ip, ipCount, b.window)
+	}
+
+	subnetCount := b.subnets.add(subnet, ll.Time)
+	if subnetCount > s.peak {
+		s.peak = subnetCount
+	}
+	if b.crossed("subnet "+subnet, subnetCount, b.subnetThreshold) {
+		s.alerted = true
+		fmt.Fprintf(w, "%s ALERT subnet %s: %d failures from %d IPs in %s\n",
+			ll.Time.Format(time.RFC3339), subnet, subnetCount, b.ipsInWindow(s, subnet), b.window)
+	}
+}
+
+// ipsInWindow counts the IPs of s that failed within the subnet's current window
+func (b *bruteforceDetector) ipsInWindow(s *subnetFailures, subnet string) int {
+	cutoff := b.subnets.last(subnet).Add(-b.window)
+	n := 0
+	for ip := range s.ips {
+		if b.ips.last(ip).After(cutoff) {
+			n++
+		}
+	}
+	return n
+}
+
+// crossed reports whether count has just reached threshold for key; it re-arms once count drops back
+func (b *bruteforceDetector) crossed(key string, count int, threshold int) bool {
+	if threshold <= 0 {
+		return false
+	}
+	if count < threshold {
+		delete(b.alerting, key)
+		return false
+	}
+	if b.alerting[key] {
+		return false
+	}
+	b.alerting[key] = true
+	return true
+}
+
+// write prints the overall picture, then each subnet's failures; subnets that alerted while every IP stayed
+// under the per-IP threshold within any one window are flagged as distributed
+func (b *bruteforceDetector) write(w io.Writer) {
+	ips := map[string]bool{}
+	result := make([]*subnetFailures, 0, len(b.summary))
+	for _, s := range b.summary {
+		for ip := range s.ips {
+			ips[ip] = true
+		}
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].failures != result[j].failures {
+			return result[i].failures > result[j].failures
+		}
+		return result[i].subnet < result[j].subnet
+	})
+
+	fmt.Fprintf(w, "%d failures from %d IPs in %d subnets", b.total, len(ips), len(result))
+	if b.peak > 0 {
+		fmt.Fprintf(w, "; busiest %s window: %d failures, ending %s", b.window, b.peak, b.peakAt.Format(time.RFC3339))
+	}
+	fmt.Fprintln(w)
+
+	for _, s := range result {
+		ipPeak := 0
+		for _, n := range s.ips {
+			if n > ipPeak {
+				ipPeak = n
+			}
+		}
+		note := ""
+		if s.alerted && ipPeak < b.threshold {
+			note = "\tdistributed"
+		}
+		fmt.Fprintf(w, "%8d %s\t%d IPs\tpeak %d/%s%s\n", s.failures, s.subnet, len(s.ips), s.peak, b.window, note)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBruteforceDistributed(t *testing.T) {
+	b := newBruteforceDetector()
+	b.paths = pathMatcher{"/login"}
+	b.fails = []failRule{{status: 401}}
+	b.window = time.Minute
+	b.threshold = 3
+	b.subnetThreshold = 4
+	b.v4Bits, b.v6Bits = 24, 64
+	b.start()
+
+	// 10.0.0.1 fails three times over the file, but never more than once a window; the subnet as a whole
+	// crosses its threshold in the last minute, when 10.0.0.9's failure is long gone
+	failures := []struct {
+		ip string
+		at int // seconds after 13:00
+	}{
+		{"10.0.0.9", 0},
+		{"10.0.0.1", 10}, {"10.0.0.1", 120}, {"10.0.0.1", 240},
+		{"10.0.0.2", 250}, {"10.0.0.3", 260}, {"10.0.0.4", 270},
+	}
+	parser := logFormats["combined"]()
+	var out bytes.Buffer
+	for _, f := range failures {
+		when := time.Date(2023, 10, 10, 13, 0, f.at, 0, time.UTC).Format("02/Jan/2006:15:04:05 -0700")
+		ll, err := parser.ParseLine(fmt.Sprintf(`%s - - [%s] "POST /login HTTP/1.1" 401 10 "-" "x"`, f.ip, when))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.add(&out, ll)
+	}
+	if strings.Contains(out.String(), "ALERT ip") {
+		t.Errorf("unexpected IP alert:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "ALERT subnet 10.0.0.0/24: 4 failures from 4 IPs in 1m0s") {
+		t.Errorf("no subnet alert counting the 4 IPs in the window:\n%s", out.String())
+	}
+
+	out.Reset()
+	b.write(&out)
+	if !strings.Contains(out.String(), "10.0.0.0/24\t5 IPs\tpeak 4/1m0s\tdistributed") {
+		t.Errorf("subnet not flagged as distributed:\n%s", out.String())
+	}
+}
@@ -4,7 +4,15 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func init() {
@@ -27,15 +35,105 @@ func init() {
 
 	ipsFS := flag.NewFlagSet("ips", errHandle)
 	ipsFS.Bool("resolve", false, "resolve IPs to hostnames where possible")
+	ipsPeer := ipsFS.Bool("peer", false, "list the address that connected rather than the client found with -trusted-proxies")
+	ipsGroupBy := ipsFS.String("group-by", "", fmt.Sprintf("count lines by a field instead of listing IPs (%s, %s, or param:NAME)", strings.Join(geoFields, ", "), sourceField))
+	ipsGroups := newCounter()
 	newCommand(ipsFS, func(ll *LogLine) {
+		if *ipsGroupBy != "" {
+			ipsGroups.add(lineField(ll, *ipsGroupBy))
+			return
+		}
+		if *ipsPeer && ll.Peer != nil {
+			fmt.Println(ll.Peer.String())
+			return
+		}
 		fmt.Println(ll.IP.String())
+	}, func(args []string) error {
+		if *ipsGroupBy == "" {
+			return nil
+		}
+		return checkField(*ipsGroupBy)
+	}).withSummary(func() {
+		ipsGroups.write(os.Stdout, nil)
 	})
 
 	pathsFS := flag.NewFlagSet("paths", errHandle)
+	paths := newPathTemplater()
+	pathsFS.BoolVar(&paths.auto, "template", false, "collapse numeric IDs, UUIDs, hashes, dates and tokens into placeholders like {id}")
+	pathsRoutes := pathsFS.String("routes", "", "comma-separated route files: OpenAPI / Swagger specs (.json, .yaml) or lists of paths like /users/{id}")
+	pathsFS.StringVar(&paths.query, "query", queryKeep, fmt.Sprintf("what to do with query strings (%s)", strings.Join(queryModes, ", ")))
+	pathsCount := pathsFS.Bool("count", false, "count requests per path instead of listing them")
+	pathsCounts := newCounter()
 	newCommand(pathsFS, func(ll *LogLine) {
-		if ll.Request != nil && ll.Request.URL != nil {
-			fmt.Println(ll.Request.URL.String())
+		if ll.Request == nil || ll.Request.URL == nil {
+			return
+		}
+		path := ll.Request.URL.String()
+		if paths.active() {
+			path = paths.template(ll.Request.URL)
 		}
+		if *pathsCount {
+			pathsCounts.add(path)
+			return
+		}
+		fmt.Println(path)
+	}, func(args []string) error {
+		switch paths.query {
+		case queryKeep, queryStrip, queryKeys:
+		default:
+			return fmt.Errorf("unknown -query mode: %s", paths.query)
+		}
+		if *pathsRoutes != "" {
+			for _, file := range strings.Split(*pathsRoutes, ",") {
+				if err := paths.addRoutes(file); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}).withSummary(func() {
+		pathsCounts.write(os.Stdout, nil)
+	})
+
+	paramsFS := flag.NewFlagSet("params", errHandle)
+	params := newParamSummary()
+	paramsKey := paramsFS.String("param", "", "count the values of this query parameter instead of summarizing all of them")
+	paramsFS.IntVar(&params.maxLength, "max-length", 256, "flag values longer than this many bytes as suspicious (0 to disable)")
+	paramsFS.Float64Var(&params.minEntropy, "entropy", 4.0, "flag values with at least this many bits of entropy per byte as suspicious (0 to disable)")
+	paramsSuspicious := paramsFS.Bool("suspicious", false, "print each suspicious value as it's seen")
+	paramsValues := newCounter()
+	newCommand(paramsFS, func(ll *LogLine) {
+		if ll.Request == nil || ll.Request.URL == nil || ll.Request.URL.RawQuery == "" {
+			return
+		}
+		query := ll.Request.URL.Query()
+		if *paramsKey != "" {
+			for _, v := range query[*paramsKey] {
+				paramsValues.add(v)
+			}
+			return
+		}
+		keys := make([]string, 0, len(query))
+		for k := range query {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, v := range query[k] {
+				if reason := params.add(k, v); reason != "" && *paramsSuspicious {
+					fmt.Printf("%s [%s] %s=%s\t%s\n", ll.IP, ll.Time.Format(nginxTimeFormat), k, shorten(v, 80), reason)
+				}
+			}
+		}
+	}).withSummary(func() {
+		if *paramsKey != "" {
+			paramsValues.write(os.Stdout, nil)
+			return
+		}
+		if *paramsSuspicious {
+			fmt.Println()
+		}
+		params.write(os.Stdout)
 	})
 
 	reqsFS := flag.NewFlagSet("requests", errHandle)
@@ -46,10 +144,67 @@ func init() {
 	})
 
 	refsFS := flag.NewFlagSet("referers", errHandle)
+	refsBy := refsFS.String("by", refererByURL, fmt.Sprintf("what to report for each referer (%s)", strings.Join(refererByModes, ", ")))
+	refsSite := refsFS.String("site", "", "comma-separated domains, subdomains included, that count as internal")
+	refsSpam := refsFS.String("spam", "", "file of spam referer domains, one per line")
+	refsCount := refsFS.Bool("count", false, "count referers instead of listing them")
+	refs := newRefererClassifier()
+	refsCounts := newCounter()
 	newCommand(refsFS, func(ll *LogLine) {
-		if ll.Referer != nil {
-			fmt.Println(ll.Referer.String())
+		ref := ll.Referer
+		var out string
+		switch *refsBy {
+		case refererByClass:
+			out = refs.classify(ref)
+		case refererByURL:
+			if ref == nil {
+				return
+			}
+			out = ref.String()
+		default:
+			if ref == nil || ref.Hostname() == "" {
+				return
+			}
+			switch *refsBy {
+			case refererByHost:
+				out = strings.ToLower(ref.Hostname())
+			case refererByDomain:
+				out = registrableDomain(ref.Hostname())
+			case refererBySearch:
+				name, terms, ok := searchEngine(ref)
+				if !ok {
+					return
+				}
+				out = name
+				if terms != "" {
+					out += "\t" + terms
+				}
+			}
+		}
+		if *refsCount {
+			refsCounts.add(out)
+			return
 		}
+		fmt.Println(out)
+	}, func(args []string) error {
+		switch *refsBy {
+		case refererByURL, refererByHost, refererByDomain, refererByClass, refererBySearch:
+		default:
+			return fmt.Errorf("unknown -by mode: %s", *refsBy)
+		}
+		for _, d := range strings.Split(*refsSite, ",") {
+			refs.site.add(d)
+		}
+		if *refsSpam != "" {
+			spam, err := loadDomainList(*refsSpam)
+			if err != nil {
+				return err
+			}
+			refs.spam = spam
+		}
+		return nil
+	}).withSummary(func() {
+		refsCounts.write(os.Stdout, nil)
 	})
 
 	statsFS := flag.NewFlagSet("statuses", errHandle)
@@ -69,18 +224,594 @@ func init() {
 		fmt.Println(ll.UserAgent)
 	})
 
+	termsFS := flag.NewFlagSet("terminations", errHandle)
+	termsFull := termsFS.Bool("full", false, "group by the full four-character HAProxy termination state")
+	terms := newCounter()
+	newCommand(termsFS, func(ll *LogLine) {
+		if ll.HAProxy == nil {
+			return
+		}
+		state := ll.HAProxy.TerminationState
+		if !*termsFull && len(state) > 2 {
+			state = state[:2]
+		}
+		terms.add(state)
+	}).withSummary(func() {
+		terms.write(os.Stdout, describeTermination)
+	})
+
+	errorsFS := flag.NewFlagSet("errors", errHandle)
+	errorsLevel := errorsFS.String("level", "", "only count error log messages at this level or more severe")
+	errorsCounts := newCounter()
+	newCommand(errorsFS, func(ll *LogLine) {
+		e := ll.ErrorLog
+		if e == nil || errorLevelRank(e.Level) < errorLevelRank(*errorsLevel) {
+			return
+		}
+		errorsCounts.add(fmt.Sprintf("[%s] %s", e.Level, errorTemplate(e.Message)))
+	}, func(args []string) error {
+		if *errorsLevel != "" && errorLevelRank(*errorsLevel) < 0 {
+			return fmt.Errorf("unknown level: %s", *errorsLevel)
+		}
+		return nil
+	}).withSummary(func() {
+		errorsCounts.write(os.Stdout, nil)
+	})
+
+	attacksFS := flag.NewFlagSet("attacks", errHandle)
+	attacksSeverity := attacksFS.String("severity", "low", fmt.Sprintf("only report findings at this severity or above (%s)", strings.Join(severities, ", ")))
+	attacksSummaryOnly := attacksFS.Bool("summary-only", false, "only print the per-IP summary")
+	attacksSummary := newAttackSummary()
+	newCommand(attacksFS, func(ll *LogLine) {
+		var findings []finding
+		for _, f := range detectAttacks(ll) {
+			if severityRank(f.rule.severity) >= severityRank(*attacksSeverity) {
+				findings = append(findings, f)
+			}
+		}
+		if len(findings) == 0 {
+			return
+		}
+		attacksSummary.add(ll.IP.String(), findings)
+		if *attacksSummaryOnly {
+			return
+		}
+		for _, f := range findings {
+			fmt.Printf("%s [%s] %s\n", ll.IP, ll.Time.Format(nginxTimeFormat), f)
+		}
+	}, func(args []string) error {
+		if severityRank(*attacksSeverity) < 0 {
+			return fmt.Errorf("unknown severity: %s", *attacksSeverity)
+		}
+		return nil
+	}).withSummary(func() {
+		if !*attacksSummaryOnly {
+			fmt.Println()
+		}
+		attacksSummary.write(os.Stdout)
+	})
+
+	detectFS := flag.NewFlagSet("detect", errHandle)
+	detectRules := detectFS.String("rules", "", "comma-separated Sigma-style YAML rule files or globs; more files may follow the options")
+	detectLevel := detectFS.String("level", "informational", fmt.Sprintf("only report rules at this level or above (%s)", strings.Join(sigmaLevels, ", ")))
+	var rules []*sigmaRule
+	newCommand(detectFS, func(ll *LogLine) {
+		for _, rule := range rules {
+			if rule.matches(ll) {
+				fmt.Printf("[%s] %s: %s\n", rule.Level, rule.Title, ll.Raw)
+			}
+		}
+	}, func(args []string) error {
+		if sigmaLevelRank(*detectLevel) < 0 {
+			return fmt.Errorf("unknown level: %s", *detectLevel)
+		}
+		patterns := detectFS.Args()
+		if *detectRules != "" {
+			patterns = append(strings.Split(*detectRules, ","), patterns...)
+		}
+		if len(patterns) == 0 {
+			return fmt.Errorf("no rules specified")
+		}
+		loaded, err := loadSigmaRules(patterns)
+		if err != nil {
+			return err
+		}
+		for _, rule := range loaded {
+			if sigmaLevelRank(rule.Level) >= sigmaLevelRank(*detectLevel) {
+				rules = append(rules, rule)
+			}
+		}
+		if len(rules) == 0 {
+			return fmt.Errorf("no web server rules loaded")
+		}
+		return nil
+	})
+
+	bfFS := flag.NewFlagSet("bruteforce", errHandle)
+	bf := newBruteforceDetector()
+	bfPaths := bfFS.String("path", "/login", "comma-separated login paths; a trailing * matches by prefix")
+	bfFS.StringVar(&bf.method, "method", "", "only count requests with this method, e.g. POST")
+	bfFails := bfFS.String("fail", "401,403", "comma-separated statuses that mean a failed login; 200<512 means a 200 under 512 bytes")
+	bfFS.DurationVar(&bf.window, "window", 5*time.Minute, "sliding window of log time to count failures over")
+	bfFS.IntVar(&bf.threshold, "threshold", 20, "failures from one IP within the window that trigger an alert")
+	bfFS.IntVar(&bf.subnetThreshold, "subnet-threshold", 50, "failures from one subnet within the window that trigger an alert")
+	bfFS.IntVar(&bf.v4Bits, "v4-prefix", 24, "prefix length used to group IPv4 addresses into subnets")
+	bfFS.IntVar(&bf.v6Bits, "v6-prefix", 64, "prefix length used to group IPv6 addresses into subnets")
+	newCommand(bfFS, func(ll *LogLine) {
+		bf.add(os.Stdout, ll)
+	}, func(args []string) error {
+		fails, err := parseFailRules(*bfFails)
+		if err != nil {
+			return err
+		}
+		bf.fails = fails
+		bf.paths = pathMatcher(strings.Split(*bfPaths, ","))
+		if bf.window <= 0 {
+			return fmt.Errorf("-window must be positive")
+		}
+		if bf.v4Bits < 0 || bf.v4Bits > 32 || bf.v6Bits < 0 || bf.v6Bits > 128 {
+			return fmt.Errorf("invalid prefix length")
+		}
+		bf.start()
+		return nil
+	}).withSummary(func() {
+		fmt.Println()
+		bf.write(os.Stdout)
+	})
+
+	botsFS := flag.NewFlagSet("bots", errHandle)
+	bots := newBotClassifier()
+	botsRanges := botsFS.String("ranges", "", "comma-separated crawler IP range files, as name=file (e.g. googlebot=googlebot.json) or just file for any crawler")
+	botsFS.BoolVar(&bots.dns, "dns", false, "verify crawlers with forward-confirmed reverse DNS")
+	botsFS.DurationVar(&bots.dnsTimeout, "dns-timeout", 2*time.Second, "how long to wait for each DNS verification")
+	botsClass := botsFS.String("class", "", fmt.Sprintf("comma-separated classes to print lines for (%s)", strings.Join(botClasses, ", ")))
+	botsSummaryOnly := botsFS.Bool("summary-only", false, "only print the per-class summary")
+	botsCounts := newCounter()
+	botsShow := map[string]bool{}
+	newCommand(botsFS, func(ll *LogLine) {
+		class, name := bots.classify(ll)
+		key := class
+		if name != "" {
+			key += " " + name
+		}
+		botsCounts.add(key)
+		if *botsSummaryOnly || (len(botsShow) > 0 && !botsShow[class]) {
+			return
+		}
+		fmt.Printf("%s\t%s\n", key, ll.Raw)
+	}, func(args []string) error {
+		if *botsRanges != "" {
+			if err := bots.loadRanges(strings.Split(*botsRanges, ",")); err != nil {
+				return err
+			}
+		}
+		for _, class := range strings.Split(*botsClass, ",") {
+			switch class {
+			case "":
+				continue
+			case botVerified, botClaimed, botGeneric, botHuman:
+				botsShow[class] = true
+			default:
+				return fmt.Errorf("unknown class: %s", class)
+			}
+		}
+		return nil
+	}).withSummary(func() {
+		if !*botsSummaryOnly {
+			fmt.Println()
+		}
+		botsCounts.write(os.Stdout, nil)
+	})
+
+	sqlFS := flag.NewFlagSet("sql", errHandle)
+	sqlFormat := sqlFS.String("format", sqlFormatTSV, fmt.Sprintf("output format (%s)", strings.Join(sqlFormats, ", ")))
+	sqlHeader := sqlFS.Bool("header", true, "print a line of column names first (tsv and csv)")
+	var query *sqlQuery
+	newCommand(sqlFS, func(ll *LogLine) {
+		// once a LIMIT is met the rest of the input can't change the result
+		if query.full() {
+			return
+		}
+		query.add(ll)
+		if query.full() {
+			stopReading()
+		}
+	}, func(args []string) error {
+		switch *sqlFormat {
+		case sqlFormatTSV, sqlFormatCSV, sqlFormatJSON:
+		default:
+			return fmt.Errorf("unknown -format: %s", *sqlFormat)
+		}
+		// the query may be quoted as one argument or not at all
+		src := strings.Join(sqlFS.Args(), " ")
+		if strings.TrimSpace(src) == "" {
+			return fmt.Errorf("usage: axe [global options] sql [options] \"SELECT ...\"; columns are %s", strings.Join(sqlColumnNames, ", "))
+		}
+		var err error
+		if query, err = parseSQL(src); err != nil {
+			return err
+		}
+		query.out = newSQLWriter(os.Stdout, *sqlFormat, *sqlHeader)
+		return nil
+	}).withSummary(func() {
+		query.finish()
+	})
+
+	reportFS := flag.NewFlagSet("report", errHandle)
+	rep := newReport()
+	reportHTML := reportFS.String("html", "", "file to write the report to as a self-contained HTML page, or - for STDOUT")
+	reportFS.StringVar(&rep.title, "title", "", "title of the report (default: the files given to -merge, or Access log report)")
+	reportFS.IntVar(&rep.top, "top", 20, "how many rows each top list shows")
+	reportFS.BoolVar(&rep.template, "template", false, "collapse IDs in paths into placeholders like {id}, as paths -template does")
+	var reportOut *os.File
+	newCommand(reportFS, func(ll *LogLine) {
+		rep.add(ll)
+	}, func(args []string) error {
+		switch *reportHTML {
+		case "":
+			return fmt.Errorf("usage: axe [global options] report -html out.html")
+		case "-":
+			reportOut = os.Stdout
+		default:
+			// created now so that a bad path is found before the logs are read
+			f, err := os.Create(*reportHTML)
+			if err != nil {
+				return err
+			}
+			reportOut = f
+		}
+		if rep.top <= 0 {
+			return fmt.Errorf("-top must be positive")
+		}
+		if rep.title == "" {
+			rep.title = "Access log report"
+			if *merge {
+				rep.title = strings.Join(mergeFiles, ", ")
+			}
+		}
+		errorFunc = rep.addError
+		return nil
+	}).withSummary(func() {
+		err := rep.write(reportOut)
+		if reportOut != os.Stdout {
+			if cerr := reportOut.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			log.Fatalf("error: report: %v", err)
+		}
+	})
+
+	anonFS := flag.NewFlagSet("anonymize", errHandle)
+	anon := newAnonymizer()
+	anonFS.StringVar(&anon.ipMode, "ip", anonIPTruncate, fmt.Sprintf("how to rewrite IPs (%s)", strings.Join(anonIPModes, ", ")))
+	anonFS.IntVar(&anon.v4Bits, "v4-prefix", 24, "prefix length IPv4 addresses are truncated to")
+	anonFS.IntVar(&anon.v6Bits, "v6-prefix", 48, "prefix length IPv6 addresses are truncated to")
+	anonKeyFile := anonFS.String("key-file", "", "file holding the secret key for -ip hmac; keep it to get the same pseudonyms across files")
+	anonParams := anonFS.String("redact-params", strings.Join(defaultRedactParams, ","), "comma-separated query parameters whose values are redacted")
+	anonFS.BoolVar(&anon.emails, "emails", true, "redact email addresses")
+	anonFS.BoolVar(&anon.tokens, "tokens", true, "redact bearer tokens, JWTs and AWS access keys")
+	newCommand(anonFS, func(ll *LogLine) {
+		for _, d := range ll.directives {
+			fmt.Println(d)
+		}
+		fmt.Println(anon.rewrite(ll))
+	}, func(args []string) error {
+		switch anon.ipMode {
+		case anonIPTruncate, anonIPKeep:
+		case anonIPHMAC:
+			if *anonKeyFile == "" {
+				return fmt.Errorf("-ip hmac needs -key-file")
+			}
+			if err := anon.loadKey(*anonKeyFile); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown -ip mode: %s", anon.ipMode)
+		}
+		if anon.v4Bits < 0 || anon.v4Bits > 32 || anon.v6Bits < 0 || anon.v6Bits > 128 {
+			return fmt.Errorf("invalid prefix length")
+		}
+		anon.setParams(*anonParams)
+		return nil
+	})
+
+	blockFS := flag.NewFlagSet("blocklist", errHandle)
+	blockFormat := blockFS.String("format", blockFormatCIDR, fmt.Sprintf("output format (%s)", strings.Join(blockFormats, ", ")))
+	blockName := blockFS.String("name", "axe_blocklist", "ipset / nftables set name")
+	blockAllow := blockFS.String("allow", "", "comma-separated files of IPs and CIDRs never to block")
+	blockAttacks := blockFS.String("attacks", "", fmt.Sprintf("only block IPs with bundled attack findings at this severity or above (%s)", strings.Join(severities, ", ")))
+	blockRules := blockFS.String("rules", "", "only block IPs matching these comma-separated Sigma-style rule files or globs")
+	blockMinHits := blockFS.Int("min-hits", 1, "only block IPs with at least this many matching lines")
+	blockAggregate := blockFS.Bool("aggregate", true, "collapse adjacent addresses into CIDR blocks")
+	blockHits := newCounter()
+	var blockAllowed []*net.IPNet
+	var blockSigma []*sigmaRule
+	newCommand(blockFS, func(ll *LogLine) {
+		if ll.IP == nil {
+			return
+		}
+		matched := false
+		if *blockAttacks != "" {
+			for _, f := range detectAttacks(ll) {
+				if severityRank(f.rule.severity) >= severityRank(*blockAttacks) {
+					matched = true
+					break
+				}
+			}
+		}
+		for _, rule := range blockSigma {
+			if matched {
+				break
+			}
+			matched = rule.matches(ll)
+		}
+		if matched {
+			blockHits.add(ll.IP.String())
+		}
+	}, func(args []string) error {
+		switch *blockFormat {
+		case blockFormatCIDR, blockFormatIPSet, blockFormatNft, blockFormatNginx:
+		default:
+			return fmt.Errorf("unknown format: %s", *blockFormat)
+		}
+		// without a detection every client in the log would be blocked
+		if *blockAttacks == "" && *blockRules == "" {
+			return fmt.Errorf("specify -attacks, -rules, or both")
+		}
+		if *blockAttacks != "" && severityRank(*blockAttacks) < 0 {
+			return fmt.Errorf("unknown severity: %s", *blockAttacks)
+		}
+		if *blockRules != "" {
+			loaded, err := loadSigmaRules(strings.Split(*blockRules, ","))
+			if err != nil {
+				return err
+			}
+			if len(loaded) == 0 {
+				return fmt.Errorf("no web server rules loaded")
+			}
+			blockSigma = loaded
+		}
+		if *blockAllow != "" {
+			allowed, err := loadAllowlist(strings.Split(*blockAllow, ","))
+			if err != nil {
+				return err
+			}
+			blockAllowed = allowed
+		}
+		return nil
+	}).withSummary(func() {
+		nets := blockNets(blockHits, *blockMinHits, blockAllowed, *blockAggregate)
+		writeBlocklist(os.Stdout, *blockFormat, *blockName, nets)
+	})
+
+	listenFS := flag.NewFlagSet("listen", errHandle)
+	listenUDP := listenFS.String("udp", "", "address to receive syslog datagrams on, e.g. :5140")
+	listenTCP := listenFS.String("tcp", "", "address to accept newline-delimited TCP streams on, e.g. :5140")
+	listenInterval := listenFS.Duration("interval", 0, "also print the command's summary this often, e.g. 1m")
+	var listenCmd *command
+	listenCmd = newCommand(listenFS, defaultPrintFunc, func(args []string) error {
+		if *listenUDP == "" && *listenTCP == "" {
+			return fmt.Errorf("specify -udp, -tcp, or both")
+		}
+
+		// anything after our own options is the command to run on each line
+		if rest := listenFS.Args(); len(rest) > 0 {
+			sub := cmdList.find(rest[0])
+			if sub == nil || sub == listenCmd {
+				return fmt.Errorf("command not found: %s", rest[0])
+			}
+			pf, err := sub.execute(rest[1:])
+			if err != nil {
+				return err
+			}
+			listenCmd.pf, listenCmd.sf = pf, sub.sf
+		}
+
+		l := newListener()
+		if *listenUDP != "" {
+			if err := l.listenUDP(*listenUDP); err != nil {
+				return err
+			}
+		}
+		if *listenTCP != "" {
+			if err := l.listenTCP(*listenTCP); err != nil {
+				return err
+			}
+		}
+		l.announce()
+
+		// nginx's syslog: output always carries a header
+		*syslogHeaders = true
+		input = l.r
+		summaryInterval = *listenInterval
+
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			<-sig
+			l.close()
+		}()
+
+		return nil
+	})
+
+	tuiFS := flag.NewFlagSet("tui", errHandle)
+	tuiFollow := tuiFS.Bool("follow", false, "keep reading the file as it grows, like tail -f")
+	tuiTemplate := tuiFS.Bool("template", false, "collapse IDs in paths into placeholders like {id}, as paths -template does")
+	tuiKeep := tuiFS.Int("keep", 1000000, "with -follow, how many of the latest lines to keep; older ones drop out of the counts (0 keeps all)")
+	var dash *dashboard
+	newCommand(tuiFS, func(ll *LogLine) {
+		dash.add(ll)
+	}, func(args []string) error {
+		name := "STDIN"
+		switch rest := tuiFS.Args(); {
+		case len(rest) > 1:
+			return fmt.Errorf("usage: axe [global options] tui [options] [file]")
+		case len(rest) == 1:
+			if *merge {
+				return fmt.Errorf("give the files to -merge instead")
+			}
+			f, err := os.Open(rest[0])
+			if err != nil {
+				return err
+			}
+			name = rest[0]
+			input = f
+			if *tuiFollow {
+				input = &followReader{f: f, name: rest[0]}
+			}
+		case *merge:
+			name = strings.Join(mergeFiles, ", ")
+		case *tuiFollow:
+			return fmt.Errorf("-follow needs a file")
+		}
+
+		if *tuiKeep < 0 {
+			return fmt.Errorf("-keep can't be negative")
+		}
+		keep := 0
+		if *tuiFollow {
+			keep = *tuiKeep
+		}
+		dash = newDashboard(name, *tuiFollow, *tuiTemplate, keep)
+		beforeStart = dash.start
+		errorFunc = dash.addError
+		return nil
+	}).withSummary(func() {
+		dash.wait()
+	})
+
+	expFS := flag.NewFlagSet("exporter", errHandle)
+	exp := newExporter()
+	expListen := expFS.String("listen", ":9113", "address to serve metrics on at /metrics")
+	expFile := expFS.String("f", "", "log file to follow, like tail -F; STDIN is read if not given")
+	expFromStart := expFS.Bool("from-start", false, "count the lines already in the -f file, rather than only new ones")
+	expFS.IntVar(&exp.maxRoutes, "max-routes", 100, "how many routes get their own route label; later ones are counted as other, and 0 leaves the label out")
+	expRoutes := expFS.String("routes", "", "comma-separated route files to label requests with, as paths -routes takes")
+	expFS.BoolVar(&exp.statusClasses, "status-classes", false, "label statuses by class, e.g. 5xx, rather than by code")
+	expBuckets := expFS.String("buckets", defaultExporterBuckets, "comma-separated upper bounds of the latency histogram buckets, in seconds")
+	newCommand(expFS, func(ll *LogLine) {
+		exp.add(ll)
+	}, func(args []string) error {
+		if exp.maxRoutes < 0 {
+			return fmt.Errorf("-max-routes can't be negative")
+		}
+		buckets, err := parseBuckets(*expBuckets)
+		if err != nil {
+			return err
+		}
+		exp.buckets = buckets
+		if *expRoutes != "" {
+			for _, file := range strings.Split(*expRoutes, ",") {
+				if err := exp.paths.addRoutes(file); err != nil {
+					return err
+				}
+			}
+		}
+
+		if *expFile != "" {
+			if *merge {
+				return fmt.Errorf("-f can't be used with -merge")
+			}
+			f, err := os.Open(*expFile)
+			if err != nil {
+				return err
+			}
+			if !*expFromStart {
+				if _, err := f.Seek(0, io.SeekEnd); err != nil {
+					return err
+				}
+			}
+			input = &followReader{f: f, name: *expFile}
+		}
+
+		errorFunc = exp.addError
+		return exp.serve(*expListen)
+	}).withSummary(func() {
+		// the input has ended, but the final counts can still be scraped
+		fmt.Fprintln(os.Stderr, "input ended; serving metrics until interrupted")
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+	})
+
+	serveFS := flag.NewFlagSet("serve", errHandle)
+	serveListen := serveFS.String("listen", "127.0.0.1:8080", "address to serve the API on; give :8080 to serve other hosts too")
+	srv := &server{}
+	serveFS.IntVar(&srv.maxRows, "max-rows", 10000, "most lines /query returns, and how many it returns by default (0 for no limit)")
+	newCommand(serveFS, nil, func(args []string) error {
+		srv.paths = serveFS.Args()
+		if len(srv.paths) == 0 {
+			return fmt.Errorf("usage: axe [global options] serve [options] file-or-directory...")
+		}
+		if *merge {
+			return fmt.Errorf("serve always merges the files it's given; leave out -merge")
+		}
+		for _, name := range lineSelectionOptions {
+			if flag.Lookup(name).Value.String() != "" {
+				return fmt.Errorf("give -%s as a query parameter instead", name)
+			}
+		}
+		if srv.maxRows < 0 {
+			return fmt.Errorf("-max-rows can't be negative")
+		}
+		if err := checkLongLines(); err != nil {
+			return err
+		}
+		var err error
+		if srv.newParser, srv.seekParser, err = lineParsers(); err != nil {
+			return err
+		}
+		if _, err := srv.files(); err != nil {
+			return err
+		}
+		return srv.listenAndServe(*serveListen)
+	})
+
+	indexFS := flag.NewFlagSet("index", errHandle)
+	indexBlockSize := indexFS.Int64("block-size", defaultIndexBlockSize, "roughly how many bytes of log each index block covers")
+	newCommand(indexFS, nil, func(args []string) error {
+		rest := indexFS.Args()
+		if len(rest) < 2 || rest[0] != "build" {
+			return fmt.Errorf("usage: axe [global options] index [options] build file...")
+		}
+		if *logFormat == "w3c" {
+			return fmt.Errorf("w3c logs can't be indexed, since they can't be read from the middle")
+		}
+		if *indexBlockSize <= 0 {
+			return fmt.Errorf("-block-size must be positive")
+		}
+		newParser, err := baseParser()
+		if err != nil {
+			return err
+		}
+		for _, file := range rest[1:] {
+			idx, err := buildIndex(file, newParser, *indexBlockSize)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s: %s\n", indexPath(file), indexStats(idx))
+		}
+		return nil
+	})
+
 	flag.Usage = func() {
 		fmt.Println(cmdList.usageStr())
+		fmt.Println("Global options:")
 		flag.PrintDefaults()
 	}
 }
 
 type execFunc func(args []string) error
+type summaryFunc func()
 type command struct {
 	name string
 	fs   *flag.FlagSet // flag set
 	ef   execFunc      // exec function - done before returning print func
 	pf   llFunc        // print func
+	sf   summaryFunc   // summary func - run once all lines have been printed
 }
 
 func newCommand(fs *flag.FlagSet, pf llFunc, ef ...execFunc) *command {
@@ -98,6 +829,12 @@ func newCommand(fs *flag.FlagSet, pf llFunc, ef ...execFunc) *command {
 	return c
 }
 
+// withSummary sets a function to be run after the last line, for commands that aggregate
+func (c *command) withSummary(sf summaryFunc) *command {
+	c.sf = sf
+	return c
+}
+
 func (c *command) execute(args []string) (llFunc, error) {
 	err := c.fs.Parse(args)
 	if err != nil {
@@ -126,7 +863,8 @@ func (c commands) find(name string) *command {
 
 func (c commands) usageStr() string {
 	usage := "axe takes logfiles as STDIN and prints the information requested\n"
-	usage += "Usage: axe [command] [options]\n"
+	usage += "Usage: axe [global options] [command] [options]\n"
+	usage += "       axe -merge [global options] file... [command] [options]\n"
 	usage += "\nCommands and options:\n"
 
 	for _, cmd := range c {
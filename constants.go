@@ -9,6 +9,7 @@ const (
 	itemRightDelimiter                 // 5
 	itemQuotedString                   // 6
 	itemIP                             // 7
+	itemField                          // 8
 
 	// itemEOF                         // 1 - UNUSED
 	// itemNewline                     // 3 - UNUSED
@@ -24,18 +25,60 @@ const (
 	ValueNil = "NIL"
 	// ValueBodyBytes represents the number of bytes transferred
 	ValueBodyBytes = "BODY_BYTES"
+	// ValueClock represents the time of day of the request, without the date
+	ValueClock = "CLOCK"
+	// ValueDate represents the date of the request, without the time of day
+	ValueDate = "DATE"
+	// ValueErrorLevel represents the level of an error log message
+	ValueErrorLevel = "ERROR_LEVEL"
+	// ValueErrorMessage represents the message of an error log line, with its key/value tail
+	ValueErrorMessage = "ERROR_MESSAGE"
+	// ValueErrorProcess represents the process and thread IDs that logged an error
+	ValueErrorProcess = "ERROR_PROCESS"
+	// ValueForwardedFor represents the addresses in an X-Forwarded-For or Forwarded header
+	ValueForwardedFor = "FORWARDED_FOR"
+	// ValueHAProxyBackend represents HAProxy's backend and server names
+	ValueHAProxyBackend = "HAPROXY_BACKEND"
+	// ValueHAProxyClient represents HAProxy's client IP address and port
+	ValueHAProxyClient = "HAPROXY_CLIENT"
+	// ValueHAProxyConns represents HAProxy's connection counts and retries
+	ValueHAProxyConns = "HAPROXY_CONNS"
+	// ValueHAProxyFrontend represents HAProxy's frontend name
+	ValueHAProxyFrontend = "HAPROXY_FRONTEND"
+	// ValueHAProxyQueues represents HAProxy's server and backend queue positions
+	ValueHAProxyQueues = "HAPROXY_QUEUES"
+	// ValueHAProxyRequestHeaders represents HAProxy's captured request headers
+	ValueHAProxyRequestHeaders = "HAPROXY_REQUEST_HEADERS"
+	// ValueHAProxyResponseHeaders represents HAProxy's captured response headers
+	ValueHAProxyResponseHeaders = "HAPROXY_RESPONSE_HEADERS"
+	// ValueHAProxyTermination represents HAProxy's session termination state
+	ValueHAProxyTermination = "HAPROXY_TERMINATION"
+	// ValueHAProxyTimers represents HAProxy's Tq/Tw/Tc/Tr/Tt timers
+	ValueHAProxyTimers = "HAPROXY_TIMERS"
+	// ValueHost represents the host requested
+	ValueHost = "HOST"
 	// ValueIgnore represents an explicitly ignored value
 	ValueIgnore = "IGNORE"
 	// ValueIP represents the client IP address
 	ValueIP = "IP"
+	// ValueMethod represents the request method on its own
+	ValueMethod = "METHOD"
+	// ValueProto represents the request's HTTP version on its own
+	ValueProto = "PROTO"
 	// ValueReferer represents the referring URL, if any
 	ValueReferer = "REFERER"
 	// ValueRequest represents the request - method, path, HTTP version
 	ValueRequest = "REQUEST"
+	// ValueRequestTime represents the time taken to serve the request
+	ValueRequestTime = "REQUEST_TIME"
 	// ValueStatus represents the HTTP status code returned
 	ValueStatus = "STATUS"
 	// ValueTime represents the time of the request
 	ValueTime = "TIME"
+	// ValueURIQuery represents the query string of the request on its own
+	ValueURIQuery = "URI_QUERY"
+	// ValueURIStem represents the path of the request on its own
+	ValueURIStem = "URI_STEM"
 	// ValueUser represents the username supplied, if any
 	ValueUser = "USER"
 	// ValueUserAgent represents the user-agent supplied, if any
@@ -56,3 +99,6 @@ var nginxItemOrder = []*ItemParser{
 	ParserReferer,       // 7
 	ParserUserAgent,     // 8
 }
+
+// nginx's default "main" format: combined, then "$http_x_forwarded_for"
+var nginxMainItemOrder = append(append([]*ItemParser{}, nginxItemOrder...), ParserForwardedFor)
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// counter tallies occurrences of string keys for summary commands
+type counter struct {
+	counts map[string]int
+	total  int
+}
+
+func newCounter() *counter {
+	return &counter{counts: map[string]int{}}
+}
+
+func (c *counter) add(key string) {
+	c.counts[key]++
+	c.total++
+}
+
+type count struct {
+	key string
+	n   int
+}
+
+// sorted returns the keys ordered by descending count, then by key
+func (c *counter) sorted() []count {
+	result := make([]count, 0, len(c.counts))
+	for k, n := range c.counts {
+		result = append(result, count{k, n})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].n != result[j].n {
+			return result[i].n > result[j].n
+		}
+		return result[i].key < result[j].key
+	})
+	return result
+}
+
+// write prints each key with its count, most common first; describe, if not nil, annotates each key
+func (c *counter) write(w io.Writer, describe func(string) string) {
+	for _, ct := range c.sorted() {
+		if describe != nil {
+			fmt.Fprintf(w, "%8d %s\t%s\n", ct.n, ct.key, describe(ct.key))
+		} else {
+			fmt.Fprintf(w, "%8d %s\n", ct.n, ct.key)
+		}
+	}
+}
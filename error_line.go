@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var nginxErrorTimeFormat = "2006/01/02 15:04:05"
+
+// nginxErrorLevels lists nginx's error log levels, least severe first
+var nginxErrorLevels = []string{"debug", "info", "notice", "warn", "error", "crit", "alert", "emerg"}
+
+// $date $time [$level] $pid#$tid: [*$connection] $message[, $key: $value...]
+var nginxErrorItemOrder = []*ItemParser{
+	ParserErrorTime,    // 0
+	ParserErrorLevel,   // 1
+	ParserErrorProcess, // 2
+	ParserErrorMessage, // 3
+}
+
+// ErrorLine represents the parts of an nginx error log line that have no access log equivalent
+type ErrorLine struct {
+	Level  string
+	PID    int
+	TID    int
+	ConnID int64 // 0 if the message isn't tied to a connection
+	// Message is the free-form text, without the key/value tail
+	Message string
+	// Fields holds the key/value tail nginx appends, e.g. client, server, request, upstream, host
+	Fields map[string]string
+}
+
+// errorLog returns l.ErrorLog, creating it first if necessary
+func (l *LogLine) errorLog() *ErrorLine {
+	if l.ErrorLog == nil {
+		l.ErrorLog = &ErrorLine{Fields: map[string]string{}}
+	}
+	return l.ErrorLog
+}
+
+// addError handles the value types produced by the nginx error log item parsers
+func (l *LogLine) addError(input value) {
+	switch input.valueType {
+	case ValueErrorLevel:
+		level, ok := input.obj.(string)
+		if !l.invalidValueErr(ok, input) {
+			l.errorLog().Level = level
+		}
+	case ValueErrorProcess:
+		ids, ok := input.obj.([]int)
+		if !l.invalidValueErr(ok, input) {
+			l.errorLog().PID, l.errorLog().TID = ids[0], ids[1]
+		}
+	case ValueErrorMessage:
+		msg, ok := input.obj.(*ErrorLine)
+		if !l.invalidValueErr(ok, input) {
+			e := l.errorLog()
+			e.ConnID, e.Message, e.Fields = msg.ConnID, msg.Message, msg.Fields
+			l.addErrorFields(e.Fields)
+		}
+	}
+}
+
+// addErrorFields fills in the access log fields that nginx repeats in an error message's tail
+func (l *LogLine) addErrorFields(fields map[string]string) {
+	if client, ok := fields["client"]; ok {
+		l.IP = net.ParseIP(client)
+	}
+	if request, ok := fields["request"]; ok {
+		if v, err := parseRequest(item{itemQuotedString, 0, request}); err == nil {
+			l.add(v)
+		}
+	}
+	if host, ok := fields["host"]; ok && l.Request != nil {
+		l.Request.Host = host
+	}
+	if referrer, ok := fields["referrer"]; ok {
+		if u, err := url.Parse(referrer); err == nil {
+			l.Referer = u
+		}
+	}
+}
+
+// ParserErrorTime takes date and time items, producing a time.Time
+var ParserErrorTime = &ItemParser{
+	valueType: ValueTime,
+	producers: []itemProducer{wordProducer, wordProducer},
+	parseFn:   parseErrorTime,
+}
+
+func parseErrorTime(input ...item) (value, error) {
+	t, err := time.ParseInLocation(nginxErrorTimeFormat, input[0].val+" "+input[1].val, time.Local)
+	if err != nil {
+		return nilVal(input), err
+	}
+	return value{input, t, ValueTime}, nil
+}
+
+// ParserErrorLevel takes left delimiter, level, and right delimiter items, producing a string
+var ParserErrorLevel = &ItemParser{
+	valueType: ValueErrorLevel,
+	producers: []itemProducer{leftDelimProducer, wordProducer, rightDelimProducer},
+	parseFn:   parseErrorLevel,
+}
+
+func parseErrorLevel(input ...item) (value, error) {
+	if errorLevelRank(input[1].val) < 0 {
+		return nilVal(input), fmt.Errorf("unknown level")
+	}
+	return value{input, input[1].val, ValueErrorLevel}, nil
+}
+
+// ParserErrorProcess takes a field item and produces a []int of pid and tid
+var ParserErrorProcess = &ItemParser{
+	valueType: ValueErrorProcess,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseErrorProcess,
+}
+
+func parseErrorProcess(input ...item) (value, error) {
+	parts := strings.SplitN(strings.TrimSuffix(input[0].val, ":"), "#", 2)
+	if len(parts) != 2 {
+		return nilVal(input), fmt.Errorf("expected pid#tid")
+	}
+	ids := make([]int, 2)
+	for i, part := range parts {
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			return nilVal(input), err
+		}
+		ids[i] = id
+	}
+	return value{input, ids, ValueErrorProcess}, nil
+}
+
+// ParserErrorMessage takes the rest of the line and produces an *ErrorLine holding the connection ID,
+// message, and key/value tail
+var ParserErrorMessage = &ItemParser{
+	valueType: ValueErrorMessage,
+	producers: []itemProducer{restProducer},
+	parseFn:   parseErrorMessage,
+}
+
+func parseErrorMessage(input ...item) (value, error) {
+	msg := input[0].val
+	e := &ErrorLine{Fields: map[string]string{}}
+
+	if strings.HasPrefix(msg, "*") {
+		if i := strings.IndexRune(msg, ' '); i > 0 {
+			if id, err := strconv.ParseInt(msg[1:i], 10, 64); err == nil {
+				e.ConnID = id
+				msg = msg[i+1:]
+			}
+		}
+	}
+
+	// nginx always starts the tail with the client when it has one
+	if i := strings.Index(msg, ", client: "); i >= 0 {
+		e.Fields = parseErrorFields(msg[i+2:])
+		msg = msg[:i]
+	}
+	e.Message = msg
+
+	return value{input, e, ValueErrorMessage}, nil
+}
+
+// parseErrorFields parses nginx's `key: value, key: "quoted value"` error message tail
+func parseErrorFields(tail string) map[string]string {
+	fields := map[string]string{}
+	for tail != "" {
+		sep := strings.Index(tail, ": ")
+		if sep < 0 {
+			break
+		}
+		key := tail[:sep]
+		tail = tail[sep+2:]
+
+		var val string
+		if strings.HasPrefix(tail, "\"") {
+			end := strings.IndexRune(tail[1:], '"')
+			if end < 0 {
+				val, tail = tail[1:], ""
+			} else {
+				val, tail = tail[1:end+1], tail[end+2:]
+			}
+		} else if end := strings.Index(tail, ", "); end >= 0 {
+			val, tail = tail[:end], tail[end:]
+		} else {
+			val, tail = tail, ""
+		}
+		fields[key] = val
+		tail = strings.TrimPrefix(tail, ", ")
+	}
+	return fields
+}
+
+// errorLevelRank returns level's position in nginxErrorLevels, or -1 if it isn't a level
+func errorLevelRank(level string) int {
+	for i, l := range nginxErrorLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// errorTemplateReplacements reduce an error message to a template by replacing its variable parts
+var errorTemplateReplacements = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`"[^"]*"`), `"<str>"`},
+	{regexp.MustCompile(`[a-z][a-z0-9+.-]*://[^\s,]+`), "<url>"},
+	{regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`), "<ip>"},
+	{regexp.MustCompile(`\b0x[0-9a-fA-F]+\b`), "<hex>"},
+	{regexp.MustCompile(`\b\d+\b`), "<n>"},
+}
+
+// errorTemplate normalizes an error message so that messages differing only in their details group together
+func errorTemplate(msg string) string {
+	for _, r := range errorTemplateReplacements {
+		msg = r.re.ReplaceAllString(msg, r.repl)
+	}
+	return msg
+}
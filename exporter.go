@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultExporterBuckets are the upper bounds of the latency histogram buckets, in seconds; the same ones
+// the Prometheus client libraries default to
+const defaultExporterBuckets = "0.005,0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5,10"
+
+// exporterOther is the label value for everything beyond a label's cardinality limit
+const exporterOther = "other"
+
+// exporterMethods are the methods given their own method label; anything else a client sends is other
+var exporterMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true, http.MethodPatch: true,
+	http.MethodDelete: true, http.MethodConnect: true, http.MethodOptions: true, http.MethodTrace: true,
+}
+
+// exporterLabels identifies one series of the request and byte counters
+type exporterLabels struct {
+	method, route, status string
+}
+
+// exporterHistogram counts request times into buckets, as a Prometheus histogram
+type exporterHistogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// exporter turns access log lines into Prometheus metrics, served over HTTP while the log is read
+type exporter struct {
+	mu sync.Mutex
+
+	// maxRoutes is how many routes get their own route label; later ones are counted as other, and 0
+	// leaves the route label out
+	maxRoutes     int
+	statusClasses bool
+	buckets       []float64
+	paths         *pathTemplater
+
+	routes    map[string]bool
+	requests  map[exporterLabels]uint64
+	bytes     map[exporterLabels]uint64
+	latencies map[exporterLabels]*exporterHistogram
+	lines     uint64
+	errors    uint64
+	latest    time.Time
+}
+
+func newExporter() *exporter {
+	return &exporter{
+		paths:     &pathTemplater{auto: true, query: queryStrip},
+		routes:    map[string]bool{},
+		requests:  map[exporterLabels]uint64{},
+		bytes:     map[exporterLabels]uint64{},
+		latencies: map[exporterLabels]*exporterHistogram{},
+	}
+}
+
+// parseBuckets parses comma-separated bucket bounds in seconds, which must increase
+func parseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || b <= 0 {
+			return nil, fmt.Errorf("invalid bucket: %s", field)
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets must increase: %s", s)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// labels returns ll's labels, keeping each within its limit
+func (e *exporter) labels(ll *LogLine) exporterLabels {
+	l := exporterLabels{method: exporterOther, status: exporterOther}
+	if ll.Request != nil && exporterMethods[ll.Request.Method] {
+		l.method = ll.Request.Method
+	}
+	if ll.Status >= 100 && ll.Status <= 599 {
+		l.status = strconv.FormatInt(ll.Status, 10)
+		if e.statusClasses {
+			l.status = l.status[:1] + "xx"
+		}
+	}
+	if e.maxRoutes > 0 {
+		l.route = exporterOther
+		if ll.Request != nil && ll.Request.URL != nil {
+			route := e.paths.template(ll.Request.URL)
+			if e.routes[route] || len(e.routes) < e.maxRoutes {
+				e.routes[route] = true
+				l.route = route
+			}
+		}
+	}
+	return l
+}
+
+func (e *exporter) add(ll *LogLine) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.lines++
+	// error log messages aren't requests
+	if ll.ErrorLog != nil {
+		return
+	}
+	if ll.Time.After(e.latest) {
+		e.latest = ll.Time
+	}
+
+	l := e.labels(ll)
+	e.requests[l]++
+	if ll.BodyBytes > 0 {
+		e.bytes[l] += uint64(ll.BodyBytes)
+	}
+
+	if ll.RequestTime > 0 {
+		// latencies aren't split by status, which would multiply the number of series by the buckets
+		l.status = ""
+		h, ok := e.latencies[l]
+		if !ok {
+			h = &exporterHistogram{counts: make([]uint64, len(e.buckets))}
+			e.latencies[l] = h
+		}
+		secs := ll.RequestTime.Seconds()
+		for i, b := range e.buckets {
+			if secs <= b {
+				h.counts[i]++
+			}
+		}
+		h.sum += secs
+		h.count++
+	}
+}
+
+// addError counts a line that couldn't be read or parsed. Only the first is printed, since a daemon
+// printing every bad line of a busy log would fill its own logs.
+func (e *exporter) addError(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lines++
+	e.errors++
+	if e.errors == 1 {
+		defaultErrFunc(err)
+		fmt.Fprintln(os.Stderr, "further errors are only counted, in axe_parse_errors_total")
+	}
+}
+
+// sortLabels puts keys in a stable order, so that scrapes list series the same way each time
+func sortLabels(keys []exporterLabels) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		return a.status < b.status
+	})
+}
+
+// labelEscaper escapes label values the only ways the exposition format allows
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// format formats the labels that are set as a Prometheus label set, with extra labels appended
+func (l exporterLabels) format(extra ...string) string {
+	var pairs []string
+	add := func(name, value string) {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(value)+`"`)
+	}
+	add("method", l.method)
+	if l.route != "" {
+		add("route", l.route)
+	}
+	if l.status != "" {
+		add("status", l.status)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		add(extra[i], extra[i+1])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// write writes the metrics in the Prometheus text exposition format
+func (e *exporter) write(w io.Writer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	header := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	header("axe_lines_total", "counter", "Lines read from the log.")
+	fmt.Fprintf(w, "axe_lines_total %d\n", e.lines)
+	header("axe_parse_errors_total", "counter", "Lines that couldn't be read or parsed.")
+	fmt.Fprintf(w, "axe_parse_errors_total %d\n", e.errors)
+	if !e.latest.IsZero() {
+		header("axe_last_request_timestamp_seconds", "gauge", "Time logged for the latest request, in seconds since the epoch.")
+		fmt.Fprintf(w, "axe_last_request_timestamp_seconds %d\n", e.latest.Unix())
+	}
+
+	counters := func(name, help string, m map[exporterLabels]uint64) {
+		keys := make([]exporterLabels, 0, len(m))
+		for l := range m {
+			keys = append(keys, l)
+		}
+		sortLabels(keys)
+		header(name, "counter", help)
+		for _, l := range keys {
+			fmt.Fprintf(w, "%s%s %d\n", name, l.format(), m[l])
+		}
+	}
+	counters("axe_http_requests_total", "Requests logged, by method, route and status.", e.requests)
+	counters("axe_http_response_bytes_total", "Response body bytes sent, by method, route and status.", e.bytes)
+
+	if len(e.latencies) == 0 {
+		return
+	}
+	keys := make([]exporterLabels, 0, len(e.latencies))
+	for l := range e.latencies {
+		keys = append(keys, l)
+	}
+	sortLabels(keys)
+	header("axe_http_request_duration_seconds", "histogram", "Time taken to serve requests, by method and route.")
+	for _, l := range keys {
+		h := e.latencies[l]
+		for i, b := range e.buckets {
+			fmt.Fprintf(w, "axe_http_request_duration_seconds_bucket%s %d\n", l.format("le", strconv.FormatFloat(b, 'g', -1, 64)), h.counts[i])
+		}
+		fmt.Fprintf(w, "axe_http_request_duration_seconds_bucket%s %d\n", l.format("le", "+Inf"), h.count)
+		fmt.Fprintf(w, "axe_http_request_duration_seconds_sum%s %s\n", l.format(), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "axe_http_request_duration_seconds_count%s %d\n", l.format(), h.count)
+	}
+}
+
+// serve starts serving the metrics on addr, returning once it's listening so that a bad address is
+// reported before the log is read
+func (e *exporter) serve(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		// a slow scraper mustn't hold up reading the log, so the lock is only held to render
+		var buf bytes.Buffer
+		e.write(&buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = buf.WriteTo(w)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, `<html><head><title>axe exporter</title></head><body><h1>axe exporter</h1><p><a href="/metrics">Metrics</a></p></body></html>`)
+	})
+
+	fmt.Fprintf(os.Stderr, "serving metrics on http://%s/metrics\n", ln.Addr())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "error: exporter: %v\n", err)
+			os.Exit(1)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// paramFieldPrefix selects a query parameter's value as a group-by field, e.g. param:utm_source
+const paramFieldPrefix = "param:"
+
+// sourceField selects the host a line came from when files are merged with -merge
+const sourceField = "source"
+
+// lineField returns the named field of ll for grouping: one of geoFields, source, or param:NAME; "-" means
+// the line doesn't have it
+func lineField(ll *LogLine, name string) string {
+	if name == sourceField {
+		if ll.Source == "" {
+			return "-"
+		}
+		return ll.Source
+	}
+	if strings.HasPrefix(name, paramFieldPrefix) {
+		if ll.Request == nil || ll.Request.URL == nil {
+			return "-"
+		}
+		values, ok := ll.Request.URL.Query()[strings.TrimPrefix(name, paramFieldPrefix)]
+		if !ok || len(values) == 0 {
+			return "-"
+		}
+		return values[0]
+	}
+	return ll.Geo.field(name)
+}
+
+// checkField returns an error if name isn't a field lineField knows, or needs a database that wasn't given
+func checkField(name string) error {
+	switch name {
+	case "asn", "org":
+		if *asnFile == "" {
+			return fmt.Errorf("field %s needs -asn", name)
+		}
+	case "country", "country-name", "city":
+		if *geoipFile == "" {
+			return fmt.Errorf("field %s needs -geoip", name)
+		}
+	case sourceField:
+		if !*merge {
+			return fmt.Errorf("field %s needs -merge", name)
+		}
+	default:
+		if !strings.HasPrefix(name, paramFieldPrefix) || name == paramFieldPrefix {
+			return fmt.Errorf("unknown field: %s", name)
+		}
+	}
+	return nil
+}
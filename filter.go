@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// routeTemplater turns request paths into the routes -route matches against, the way paths -template does
+var routeTemplater = &pathTemplater{auto: true, query: queryStrip}
+
+// requestRoute returns the route of ll's request, or "" if it has none
+func requestRoute(ll *LogLine) string {
+	if ll.Request == nil || ll.Request.URL == nil {
+		return ""
+	}
+	return routeTemplater.template(ll.Request.URL)
+}
+
+// lineFilter keeps lines from the listed IPs, with the listed statuses, for the listed routes; an empty
+// list allows everything. Built indexes can answer it without reading the lines that don't match.
+type lineFilter struct {
+	nets     []*net.IPNet
+	statuses []string
+	routes   map[string]bool
+}
+
+// parseLineFilter parses comma-separated IPs and CIDRs, statuses like 404 or 5xx, and routes like
+// /users/{id} (a path with no placeholders matches only itself)
+func parseLineFilter(ips string, statuses string, routes string) (*lineFilter, error) {
+	f := &lineFilter{routes: map[string]bool{}}
+
+	var err error
+	if f.nets, err = parseNetList(ips); err != nil {
+		return nil, err
+	}
+	for _, s := range strings.Split(statuses, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "" {
+			continue
+		}
+		if len(s) != 3 || strings.Trim(s, "0123456789x") != "" {
+			return nil, fmt.Errorf("invalid status: %s", s)
+		}
+		f.statuses = append(f.statuses, s)
+	}
+	for _, r := range strings.Split(routes, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			r = strings.SplitN(r, "?", 2)[0]
+			f.routes[routeTemplater.templatePath(r)] = true
+		}
+	}
+	return f, nil
+}
+
+func (f *lineFilter) empty() bool {
+	return len(f.nets) == 0 && len(f.statuses) == 0 && len(f.routes) == 0
+}
+
+func (f *lineFilter) matches(ll *LogLine) bool {
+	if len(f.nets) > 0 && (ll.IP == nil || !inNets(ll.IP, f.nets)) {
+		return false
+	}
+	if len(f.statuses) > 0 && !f.matchesStatus(fmt.Sprint(ll.Status)) {
+		return false
+	}
+	if len(f.routes) > 0 && !f.routes[requestRoute(ll)] {
+		return false
+	}
+	return true
+}
+
+// matchesStatus reports whether status matches any of the statuses, where x matches any digit
+func (f *lineFilter) matchesStatus(status string) bool {
+	for _, pattern := range f.statuses {
+		if len(status) != len(pattern) {
+			continue
+		}
+		ok := true
+		for i := range pattern {
+			if pattern[i] != 'x' && pattern[i] != status[i] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
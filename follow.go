@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// followPoll is how often a followed file is checked for new lines
+const followPoll = 250 * time.Millisecond
+
+// followReader reads a file like tail -F: at the end it waits for more to be written instead of stopping,
+// starting over if the file is truncated, and switching to the new file if name is moved aside and
+// recreated, as logrotate does
+type followReader struct {
+	f    *os.File
+	name string
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		if pos, err := r.f.Seek(0, io.SeekCurrent); err == nil {
+			if info, err := r.f.Stat(); err == nil && info.Size() < pos {
+				if _, err := r.f.Seek(0, io.SeekStart); err != nil {
+					return 0, err
+				}
+				continue
+			}
+		}
+		if r.reopen() {
+			continue
+		}
+		time.Sleep(followPoll)
+	}
+}
+
+// reopen switches to the file now at name if it's no longer the one being read, reporting whether it did
+func (r *followReader) reopen() bool {
+	info, err := os.Stat(r.name)
+	if err != nil {
+		return false
+	}
+	if current, err := r.f.Stat(); err != nil || os.SameFile(info, current) {
+		return false
+	}
+	f, err := os.Open(r.name)
+	if err != nil {
+		return false
+	}
+	r.f.Close()
+	r.f = f
+	return true
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// ParserForwardedFor takes a quoted string item holding an X-Forwarded-For or Forwarded header and
+// produces a []net.IP
+var ParserForwardedFor = &ItemParser{
+	valueType: ValueForwardedFor,
+	producers: []itemProducer{quotedStringProducer},
+	parseFn:   parseForwardedFor,
+}
+
+// ParserW3CForwardedFor takes a field item and produces a []net.IP, restoring the spaces IIS replaces with '+'
+var ParserW3CForwardedFor = &ItemParser{
+	valueType: ValueForwardedFor,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseW3CForwardedFor,
+}
+
+func parseForwardedFor(input ...item) (value, error) {
+	// nginx escapes the quotes Forwarded uses around IPv6 addresses as \x22
+	header := unescapeNginx(removeQuotes(input[0].val))
+	if header == "" || header == "-" {
+		return nilVal(input), nil
+	}
+	return value{input, parseForwardedList(header), ValueForwardedFor}, nil
+}
+
+func parseW3CForwardedFor(input ...item) (value, error) {
+	header := strings.Replace(input[0].val, "+", " ", -1)
+	if header == "" || header == "-" {
+		return nilVal(input), nil
+	}
+	return value{input, parseForwardedList(header), ValueForwardedFor}, nil
+}
+
+// parseForwardedList reads the addresses out of an X-Forwarded-For header ("client, proxy1, proxy2") or an
+// RFC 7239 Forwarded header ("for=client;proto=https, for=proxy1"), leftmost first; entries that aren't
+// addresses, like "unknown" or obfuscated identifiers, are kept as nil so positions in the chain still line up
+func parseForwardedList(header string) []net.IP {
+	rfc7239 := strings.Contains(strings.ToLower(header), "for=")
+
+	var result []net.IP
+	for _, hop := range strings.Split(header, ",") {
+		hop = strings.TrimSpace(hop)
+		if rfc7239 {
+			hop = forwardedParam(hop, "for")
+		}
+		if hop == "" {
+			continue
+		}
+		result = append(result, parseHostPort(hop))
+	}
+	return result
+}
+
+// forwardedParam returns the unquoted value of name in one element of a Forwarded header
+func forwardedParam(element string, name string) string {
+	for _, pair := range strings.Split(element, ";") {
+		pair = strings.TrimSpace(pair)
+		i := strings.IndexRune(pair, '=')
+		if i < 0 || !strings.EqualFold(pair[:i], name) {
+			continue
+		}
+		return strings.Trim(pair[i+1:], "\"")
+	}
+	return ""
+}
+
+// parseHostPort parses "1.2.3.4", "1.2.3.4:5678", "2001:db8::1" or "[2001:db8::1]:5678"
+func parseHostPort(s string) net.IP {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// clientIP walks the chain of addresses a request passed through, from the peer that connected back
+// towards the client, and returns the first address that isn't a trusted proxy; if every hop is trusted
+// the leftmost is the best there is, and the walk stops early at anything that isn't an address, since
+// nothing to its left can be trusted either
+func clientIP(peer net.IP, forwardedFor []net.IP, trusted []*net.IPNet) net.IP {
+	client := peer
+	if client == nil || !inNets(client, trusted) {
+		return client
+	}
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		hop := forwardedFor[i]
+		if hop == nil {
+			break
+		}
+		client = hop
+		if !inNets(hop, trusted) {
+			break
+		}
+	}
+	return client
+}
+
+// ClientIPParser replaces LogLine.IP with the real client's address, keeping the original as LogLine.Peer
+type ClientIPParser struct {
+	next    LineParser
+	trusted []*net.IPNet
+}
+
+// withTrustedProxies wraps a log format's LineParser constructor with a *ClientIPParser
+func withTrustedProxies(newParser func() LineParser, trusted []*net.IPNet) func() LineParser {
+	return func() LineParser {
+		return &ClientIPParser{next: newParser(), trusted: trusted}
+	}
+}
+
+// ParseLine resolves the client IP of the *LogLine parsed from input
+func (c *ClientIPParser) ParseLine(input string) (*LogLine, error) {
+	ll, err := c.next.ParseLine(input)
+	if ll == nil || ll.IP == nil {
+		return ll, err
+	}
+	ll.Peer = ll.IP
+	ll.IP = clientIP(ll.IP, ll.ForwardedFor, c.trusted)
+	return ll, err
+}
+
+// parseNetList parses comma-separated IPs and CIDRs
+func parseNetList(input string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, part := range strings.Split(input, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		ipNet, err := parseIPOrCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
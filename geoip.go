@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// geoCacheSize is how many IPs a GeoParser remembers before starting over
+const geoCacheSize = 100000
+
+// GeoInfo holds what the GeoIP and ASN databases know about a line's IP
+type GeoInfo struct {
+	Country     string // ISO 3166-1 alpha-2 code
+	CountryName string
+	City        string
+	ASN         uint
+	Org         string
+}
+
+// geoFields are the GeoInfo values available to -group-by
+var geoFields = []string{"country", "country-name", "city", "asn", "org"}
+
+// field returns one of geoFields, or "-" if it isn't known
+func (g *GeoInfo) field(name string) string {
+	v := ""
+	if g != nil {
+		switch name {
+		case "country":
+			v = g.Country
+		case "country-name":
+			v = g.CountryName
+		case "city":
+			v = g.City
+		case "asn":
+			if g.ASN != 0 {
+				v = "AS" + strconv.FormatUint(uint64(g.ASN), 10)
+			}
+		case "org":
+			v = g.Org
+		}
+	}
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// geoDatabases holds the MMDB files given with -geoip and -asn; either may be nil
+type geoDatabases struct {
+	city *mmdbReader
+	asn  *mmdbReader
+}
+
+// openGeoDatabases opens the databases at cityPath and asnPath, skipping any that are empty
+func openGeoDatabases(cityPath string, asnPath string) (*geoDatabases, error) {
+	g := &geoDatabases{}
+	var err error
+	if cityPath != "" {
+		if g.city, err = openMMDB(cityPath); err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		if g.asn, err = openMMDB(asnPath); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// GeoParser fills in LogLine.Geo for lines parsed by another LineParser
+type GeoParser struct {
+	next  LineParser
+	dbs   *geoDatabases
+	cache map[string]*GeoInfo
+}
+
+// withGeoIP wraps a log format's LineParser constructor with a *GeoParser
+func withGeoIP(newParser func() LineParser, dbs *geoDatabases) func() LineParser {
+	return func() LineParser {
+		return &GeoParser{next: newParser(), dbs: dbs, cache: map[string]*GeoInfo{}}
+	}
+}
+
+// ParseLine looks up the IP of the *LogLine parsed from input
+func (g *GeoParser) ParseLine(input string) (*LogLine, error) {
+	ll, err := g.next.ParseLine(input)
+	if ll == nil || ll.IP == nil {
+		return ll, err
+	}
+
+	key := string(ll.IP.To16())
+	info, ok := g.cache[key]
+	if !ok {
+		var lookupErr error
+		info, lookupErr = g.dbs.lookup(ll)
+		if lookupErr != nil && err == nil {
+			err = lookupErr
+		}
+		if len(g.cache) >= geoCacheSize {
+			g.cache = map[string]*GeoInfo{}
+		}
+		g.cache[key] = info
+	}
+	ll.Geo = info
+
+	return ll, err
+}
+
+// lookup returns what the databases know about ll's IP, or nil if they know nothing
+func (g *geoDatabases) lookup(ll *LogLine) (*GeoInfo, error) {
+	info := &GeoInfo{}
+	found := false
+
+	if g.city != nil {
+		rec, err := g.city.lookup(ll.IP)
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := rec.(map[string]interface{}); ok {
+			found = true
+			country := mmdbPath(m, "country")
+			if country == nil {
+				country = mmdbPath(m, "registered_country")
+			}
+			if c, ok := country.(map[string]interface{}); ok {
+				info.Country, _ = c["iso_code"].(string)
+				info.CountryName, _ = mmdbPath(c, "names", "en").(string)
+			}
+			info.City, _ = mmdbPath(m, "city", "names", "en").(string)
+		}
+	}
+
+	if g.asn != nil {
+		rec, err := g.asn.lookup(ll.IP)
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := rec.(map[string]interface{}); ok {
+			found = true
+			if n, ok := m["autonomous_system_number"].(uint64); ok {
+				info.ASN = uint(n)
+			}
+			info.Org, _ = m["autonomous_system_organization"].(string)
+		}
+	}
+
+	if !found {
+		return nil, nil
+	}
+	return info, nil
+}
+
+// mmdbPath follows keys down through nested maps
+func mmdbPath(v interface{}, keys ...string) interface{} {
+	for _, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// geoFilter keeps lines whose country or AS number is listed; an empty list allows everything
+type geoFilter struct {
+	countries map[string]bool
+	asns      map[uint]bool
+}
+
+// parseGeoFilter parses comma-separated country codes and AS numbers, e.g. "CN,RU" and "AS4134,13335"
+func parseGeoFilter(countries string, asns string) (*geoFilter, error) {
+	f := &geoFilter{countries: map[string]bool{}, asns: map[uint]bool{}}
+	for _, c := range strings.Split(countries, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			f.countries[strings.ToUpper(c)] = true
+		}
+	}
+	for _, a := range strings.Split(asns, ",") {
+		a = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(a)), "AS")
+		if a == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(a, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AS number: %s", a)
+		}
+		f.asns[uint(n)] = true
+	}
+	return f, nil
+}
+
+func (f *geoFilter) empty() bool {
+	return len(f.countries) == 0 && len(f.asns) == 0
+}
+
+func (f *geoFilter) matches(ll *LogLine) bool {
+	if ll.Geo == nil {
+		return false
+	}
+	if len(f.countries) > 0 && !f.countries[ll.Geo.Country] {
+		return false
+	}
+	if len(f.asns) > 0 && !f.asns[ll.Geo.ASN] {
+		return false
+	}
+	return true
+}
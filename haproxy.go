@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var haproxyTimeFormat = "02/Jan/2006:15:04:05.000"
+
+// HAProxyInfo holds the values specific to HAProxy's "option httplog" format
+type HAProxyInfo struct {
+	ClientPort int
+	Frontend   string
+	Backend    string
+	Server     string
+	Timers     HAProxyTimers
+
+	// TerminationState is the four-character session state at disconnection, e.g. "cD--"
+	TerminationState string
+
+	ActConn int
+	FeConn  int
+	BeConn  int
+	SrvConn int
+	Retries int
+
+	SrvQueue     int
+	BackendQueue int
+
+	RequestHeaders  []string
+	ResponseHeaders []string
+}
+
+// HAProxyTimers holds the Tq/Tw/Tc/Tr/Tt timer block; a negative value means the phase was never reached
+type HAProxyTimers struct {
+	Tq time.Duration // time to receive the full request
+	Tw time.Duration // time spent in queues
+	Tc time.Duration // time to connect to the server
+	Tr time.Duration // time for the server to send its response headers
+	Tt time.Duration // total session time
+}
+
+// haproxy returns l.HAProxy, creating it first if necessary
+func (l *LogLine) haproxy() *HAProxyInfo {
+	if l.HAProxy == nil {
+		l.HAProxy = &HAProxyInfo{}
+	}
+	return l.HAProxy
+}
+
+// addHAProxy handles the value types produced by the HAProxy item parsers
+func (l *LogLine) addHAProxy(input value) {
+	switch input.valueType {
+	case ValueHAProxyClient:
+		addr, ok := input.obj.(*net.TCPAddr)
+		if !l.invalidValueErr(ok, input) {
+			l.IP = addr.IP
+			l.haproxy().ClientPort = addr.Port
+		}
+	case ValueHAProxyFrontend:
+		fe, ok := input.obj.(string)
+		if !l.invalidValueErr(ok, input) {
+			l.haproxy().Frontend = fe
+		}
+	case ValueHAProxyBackend:
+		parts, ok := input.obj.([]string)
+		if !l.invalidValueErr(ok, input) {
+			l.haproxy().Backend, l.haproxy().Server = parts[0], parts[1]
+		}
+	case ValueHAProxyTimers:
+		timers, ok := input.obj.(HAProxyTimers)
+		if !l.invalidValueErr(ok, input) {
+			l.haproxy().Timers = timers
+			if timers.Tt >= 0 {
+				l.RequestTime = timers.Tt
+			}
+		}
+	case ValueHAProxyTermination:
+		state, ok := input.obj.(string)
+		if !l.invalidValueErr(ok, input) {
+			l.haproxy().TerminationState = state
+		}
+	case ValueHAProxyConns:
+		conns, ok := input.obj.([]int)
+		if !l.invalidValueErr(ok, input) {
+			h := l.haproxy()
+			h.ActConn, h.FeConn, h.BeConn, h.SrvConn, h.Retries = conns[0], conns[1], conns[2], conns[3], conns[4]
+		}
+	case ValueHAProxyQueues:
+		queues, ok := input.obj.([]int)
+		if !l.invalidValueErr(ok, input) {
+			l.haproxy().SrvQueue, l.haproxy().BackendQueue = queues[0], queues[1]
+		}
+	case ValueHAProxyRequestHeaders:
+		headers, ok := input.obj.([]string)
+		if !l.invalidValueErr(ok, input) {
+			l.haproxy().RequestHeaders = headers
+		}
+	case ValueHAProxyResponseHeaders:
+		headers, ok := input.obj.([]string)
+		if !l.invalidValueErr(ok, input) {
+			l.haproxy().ResponseHeaders = headers
+		}
+	}
+}
+
+// haproxyItemOrder returns the []*ItemParser for an httplog line with the given number of captured
+// header blocks:
+// $ip:$port [$accept_date] $frontend $backend/$server $Tq/$Tw/$Tc/$Tr/$Tt $status $bytes $req_cookie
+// $res_cookie $termination_state $actconn/$feconn/$beconn/$srv_conn/$retries $srv_queue/$backend_queue
+// [{$req_headers}] [{$res_headers}] "$req"
+func haproxyItemOrder(headerBlocks int) []*ItemParser {
+	order := []*ItemParser{
+		ParserHAProxyClient,
+		ParserHAProxyTime,
+		ParserHAProxyFrontend,
+		ParserHAProxyBackend,
+		ParserHAProxyTimers,
+		ParserHAProxyStatus,
+		ParserHAProxyBytes,
+		ParserHAProxyCookies,
+		ParserHAProxyTermination,
+		ParserHAProxyConns,
+		ParserHAProxyQueues,
+	}
+	if headerBlocks > 0 {
+		order = append(order, ParserHAProxyRequestHeaders)
+	}
+	if headerBlocks > 1 {
+		order = append(order, ParserHAProxyResponseHeaders)
+	}
+	return append(order, ParserRequest)
+}
+
+// HAProxyParser parses HAProxy "option httplog" lines, with or without their syslog header and captured
+// header blocks
+type HAProxyParser struct {
+	parsers map[int]*Parser
+}
+
+// NewHAProxyParser returns a prepared *HAProxyParser
+func NewHAProxyParser() *HAProxyParser {
+	return &HAProxyParser{parsers: map[int]*Parser{}}
+}
+
+// ParseLine strips any syslog header, then picks the *Parser for the number of captured header blocks
+func (h *HAProxyParser) ParseLine(input string) (*LogLine, error) {
+	// HAProxy almost always logs via syslog, so don't make users ask for -syslog
+	var info *SyslogInfo
+	raw := input
+	first := input
+	if i := strings.IndexRune(input, ' '); i >= 0 {
+		first = input[:i]
+	}
+	if _, _, err := splitClientAddr(first); err != nil {
+		if si, rest, ok := parseSyslogHeader(input); ok {
+			info, input = si, rest
+		}
+	}
+
+	// captured headers come after the queue counters and before the quoted request
+	headerBlocks := 0
+	if end := strings.LastIndex(input, " \""); end >= 0 {
+		headerBlocks = strings.Count(input[:end], " {")
+	}
+
+	p, ok := h.parsers[headerBlocks]
+	if !ok {
+		p = NewParser(haproxyItemOrder(headerBlocks))
+		h.parsers[headerBlocks] = p
+	}
+
+	ll, err := p.ParseLine(input)
+	if info != nil {
+		ll.Syslog = info
+		ll.shiftSpans(len(raw) - len(input))
+	}
+	return ll, err
+}
+
+// splitClientAddr splits HAProxy's $ip:$port, which doesn't bracket IPv6 addresses
+func splitClientAddr(input string) (net.IP, int, error) {
+	i := strings.LastIndex(input, ":")
+	if i < 0 {
+		return nil, 0, fmt.Errorf("missing port")
+	}
+	ip := net.ParseIP(strings.Trim(input[:i], "[]"))
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid IP")
+	}
+	port, err := strconv.Atoi(input[i+1:])
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, port, nil
+}
+
+// splitInts splits input on '/' into exactly n ints, dropping the '+' HAProxy adds to adjusted values
+func splitInts(input string, n int) ([]int, error) {
+	parts := strings.Split(input, "/")
+	if len(parts) != n {
+		return nil, fmt.Errorf("expected %d values, got %d", n, len(parts))
+	}
+	result := make([]int, n)
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimPrefix(part, "+"))
+		if err != nil {
+			return nil, err
+		}
+		result[i] = v
+	}
+	return result, nil
+}
+
+// ParserHAProxyClient takes a field item and produces a *net.TCPAddr
+var ParserHAProxyClient = &ItemParser{
+	valueType: ValueHAProxyClient,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseHAProxyClient,
+}
+
+func parseHAProxyClient(input ...item) (value, error) {
+	ip, port, err := splitClientAddr(input[0].val)
+	if err != nil {
+		return nilVal(input), err
+	}
+	return value{input, &net.TCPAddr{IP: ip, Port: port}, ValueHAProxyClient}, nil
+}
+
+// ParserHAProxyTime takes left delimiter, time, and right delimiter items, producing a time.Time
+var ParserHAProxyTime = &ItemParser{
+	valueType: ValueTime,
+	producers: []itemProducer{leftDelimProducer, wordProducer, rightDelimProducer},
+	parseFn:   parseHAProxyTime,
+}
+
+func parseHAProxyTime(input ...item) (value, error) {
+	t, err := time.ParseInLocation(haproxyTimeFormat, input[1].val, time.Local)
+	if err != nil {
+		return nilVal(input), err
+	}
+	return value{input, t, ValueTime}, nil
+}
+
+// ParserHAProxyFrontend takes a field item and produces a string
+var ParserHAProxyFrontend = &ItemParser{
+	valueType: ValueHAProxyFrontend,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseHAProxyFrontend,
+}
+
+func parseHAProxyFrontend(input ...item) (value, error) {
+	return value{input, input[0].val, ValueHAProxyFrontend}, nil
+}
+
+// ParserHAProxyBackend takes a field item and produces a []string of backend and server
+var ParserHAProxyBackend = &ItemParser{
+	valueType: ValueHAProxyBackend,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseHAProxyBackend,
+}
+
+func parseHAProxyBackend(input ...item) (value, error) {
+	parts := strings.SplitN(input[0].val, "/", 2)
+	if len(parts) != 2 {
+		return nilVal(input), fmt.Errorf("expected backend/server")
+	}
+	return value{input, parts, ValueHAProxyBackend}, nil
+}
+
+// ParserHAProxyTimers takes a field item and produces HAProxyTimers
+var ParserHAProxyTimers = &ItemParser{
+	valueType: ValueHAProxyTimers,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseHAProxyTimers,
+}
+
+func parseHAProxyTimers(input ...item) (value, error) {
+	ms, err := splitInts(input[0].val, 5)
+	if err != nil {
+		return nilVal(input), err
+	}
+	d := func(v int) time.Duration { return time.Duration(v) * time.Millisecond }
+	timers := HAProxyTimers{Tq: d(ms[0]), Tw: d(ms[1]), Tc: d(ms[2]), Tr: d(ms[3]), Tt: d(ms[4])}
+	return value{input, timers, ValueHAProxyTimers}, nil
+}
+
+// ParserHAProxyStatus takes a field item and produces an int64; HAProxy logs -1 when there's no response
+var ParserHAProxyStatus = &ItemParser{
+	valueType: ValueStatus,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseStatus,
+}
+
+// ParserHAProxyBytes takes a field item and produces an int64
+var ParserHAProxyBytes = &ItemParser{
+	valueType: ValueBodyBytes,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseHAProxyBytes,
+}
+
+func parseHAProxyBytes(input ...item) (value, error) {
+	b, err := strconv.ParseInt(strings.TrimPrefix(input[0].val, "+"), 10, 64)
+	if err != nil {
+		return nilVal(input), err
+	}
+	return value{input, b, ValueBodyBytes}, nil
+}
+
+// ParserHAProxyCookies takes the captured request and response cookie items and suppresses their addition
+var ParserHAProxyCookies = &ItemParser{
+	valueType: ValueIgnore,
+	producers: []itemProducer{fieldProducer, fieldProducer},
+	parseFn:   nil,
+}
+
+// ParserHAProxyTermination takes a field item and produces a string
+var ParserHAProxyTermination = &ItemParser{
+	valueType: ValueHAProxyTermination,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseHAProxyTermination,
+}
+
+func parseHAProxyTermination(input ...item) (value, error) {
+	if len(input[0].val) != 4 {
+		return nilVal(input), fmt.Errorf("expected 4 characters")
+	}
+	return value{input, input[0].val, ValueHAProxyTermination}, nil
+}
+
+// ParserHAProxyConns takes a field item and produces a []int of actconn/feconn/beconn/srv_conn/retries
+var ParserHAProxyConns = &ItemParser{
+	valueType: ValueHAProxyConns,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseHAProxyConns,
+}
+
+func parseHAProxyConns(input ...item) (value, error) {
+	conns, err := splitInts(input[0].val, 5)
+	if err != nil {
+		return nilVal(input), err
+	}
+	return value{input, conns, ValueHAProxyConns}, nil
+}
+
+// ParserHAProxyQueues takes a field item and produces a []int of srv_queue/backend_queue
+var ParserHAProxyQueues = &ItemParser{
+	valueType: ValueHAProxyQueues,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseHAProxyQueues,
+}
+
+func parseHAProxyQueues(input ...item) (value, error) {
+	queues, err := splitInts(input[0].val, 2)
+	if err != nil {
+		return nilVal(input), err
+	}
+	return value{input, queues, ValueHAProxyQueues}, nil
+}
+
+// ParserHAProxyRequestHeaders takes left delimiter, block, and right delimiter items, producing a []string
+var ParserHAProxyRequestHeaders = &ItemParser{
+	valueType: ValueHAProxyRequestHeaders,
+	producers: []itemProducer{leftDelimProducer, blockProducer, rightDelimProducer},
+	parseFn:   parseHAProxyHeaders(ValueHAProxyRequestHeaders),
+}
+
+// ParserHAProxyResponseHeaders takes left delimiter, block, and right delimiter items, producing a []string
+var ParserHAProxyResponseHeaders = &ItemParser{
+	valueType: ValueHAProxyResponseHeaders,
+	producers: []itemProducer{leftDelimProducer, blockProducer, rightDelimProducer},
+	parseFn:   parseHAProxyHeaders(ValueHAProxyResponseHeaders),
+}
+
+// parseHAProxyHeaders returns an ipFn splitting captured headers on '|', in capture declaration order
+func parseHAProxyHeaders(valueType string) ipFn {
+	return func(input ...item) (value, error) {
+		if input[0].val != "{" || input[2].val != "}" {
+			return nilVal(input), fmt.Errorf("expected {headers}")
+		}
+		return value{input, strings.Split(input[1].val, "|"), valueType}, nil
+	}
+}
+
+// haproxyTerminationCauses describes the first character of a termination state
+var haproxyTerminationCauses = map[byte]string{
+	'C': "aborted by the client",
+	'S': "aborted or refused by the server",
+	'P': "aborted by the proxy",
+	'L': "handled locally by the proxy",
+	'R': "proxy resource exhausted",
+	'I': "proxy internal error",
+	'D': "server went down",
+	'U': "server came back up",
+	'K': "actively killed by an admin",
+	'c': "client-side timeout",
+	's': "server-side timeout",
+	'-': "normal completion",
+}
+
+// haproxyTerminationPhases describes the second character of a termination state
+var haproxyTerminationPhases = map[byte]string{
+	'R': "waiting for the client request",
+	'Q': "waiting in queue",
+	'C': "waiting for the server connection",
+	'H': "waiting for the server response headers",
+	'D': "during the data phase",
+	'L': "transmitting the last data to the client",
+	'T': "tarpitted",
+	'-': "",
+}
+
+// describeTermination explains the first two characters of an HAProxy termination state
+func describeTermination(state string) string {
+	if len(state) < 2 {
+		return "unknown"
+	}
+	cause, ok := haproxyTerminationCauses[state[0]]
+	if !ok {
+		cause = "unknown cause"
+	}
+	if phase := haproxyTerminationPhases[state[1]]; phase != "" {
+		return cause + ", " + phase
+	}
+	return cause
+}
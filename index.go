@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// indexSuffix is added to a log file's name to get the name of its index
+const indexSuffix = ".axeidx"
+
+// indexVersion changes whenever fileIndex does, so old indexes are rebuilt rather than misread
+const indexVersion = 1
+
+// defaultIndexBlockSize is roughly how many bytes of log each index block covers; smaller blocks skip more
+// precisely but make bigger indexes
+const defaultIndexBlockSize = 64 * 1024
+
+// indexCheckSize is how much of each end of the indexed part of a file is checksummed, to notice files
+// that were replaced or rotated since the index was built
+const indexCheckSize = 4096
+
+// fileIndex divides a log file into blocks of whole lines, recording the times each block covers and which
+// blocks hold each IP, status and route
+type fileIndex struct {
+	Version int
+	// Format is the -log-format (and -syslog) the file was parsed with
+	Format string
+	// Size is how many bytes of the file were indexed; anything appended since is read as usual
+	Size       int64
+	Head, Tail uint32
+
+	Blocks   []indexBlock
+	IPs      map[string][]uint32
+	Statuses map[string][]uint32
+	Routes   map[string][]uint32
+}
+
+// indexBlock is a run of lines starting at Offset; its times are Unix nanoseconds, 0 if it had none
+type indexBlock struct {
+	Offset           int64
+	MinTime, MaxTime int64
+}
+
+// indexQuery is what an index can narrow a file down to: lines within a time range that pass a lineFilter
+type indexQuery struct {
+	window timeRange
+	filter *lineFilter
+}
+
+func (q indexQuery) empty() bool {
+	return q.window.empty() && q.filter.empty()
+}
+
+// indexPath returns where the index of file is kept
+func indexPath(file string) string {
+	return file + indexSuffix
+}
+
+// indexFormat names the parser settings an index is only good for
+func indexFormat() string {
+	if *syslogHeaders {
+		return *logFormat + "+syslog"
+	}
+	return *logFormat
+}
+
+// buildIndex reads file once with parsers from newParser and writes its index next to it
+func buildIndex(file string, newParser func() LineParser, blockSize int64) (*fileIndex, error) {
+	if strings.HasSuffix(file, ".gz") {
+		return nil, fmt.Errorf("%s: compressed files can't be indexed", file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	idx := &fileIndex{
+		Version:  indexVersion,
+		Format:   indexFormat(),
+		IPs:      map[string][]uint32{},
+		Statuses: map[string][]uint32{},
+		Routes:   map[string][]uint32{},
+	}
+	post := func(postings map[string][]uint32, key string) {
+		block := uint32(len(idx.Blocks) - 1)
+		if list := postings[key]; len(list) == 0 || list[len(list)-1] != block {
+			postings[key] = append(list, block)
+		}
+	}
+
+	parser := newParser()
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadString('\n')
+		if len(line) > 0 {
+			if len(idx.Blocks) == 0 || offset-idx.Blocks[len(idx.Blocks)-1].Offset >= blockSize {
+				idx.Blocks = append(idx.Blocks, indexBlock{Offset: offset})
+			}
+			offset += int64(len(line))
+
+			ll, _ := parser.ParseLine(strings.TrimRight(line, "\r\n"))
+			if ll != nil {
+				block := &idx.Blocks[len(idx.Blocks)-1]
+				if !ll.Time.IsZero() {
+					t := ll.Time.UnixNano()
+					if block.MinTime == 0 || t < block.MinTime {
+						block.MinTime = t
+					}
+					if t > block.MaxTime {
+						block.MaxTime = t
+					}
+				}
+				// with -trusted-proxies the client can be any of these, so they're all posted
+				for _, ip := range append([]net.IP{ll.IP}, ll.ForwardedFor...) {
+					if ip != nil {
+						post(idx.IPs, ip.String())
+					}
+				}
+				if ll.Status != 0 {
+					post(idx.Statuses, strconv.FormatInt(ll.Status, 10))
+				}
+				if route := requestRoute(ll); route != "" {
+					post(idx.Routes, route)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+
+	idx.Size = offset
+	if idx.Head, idx.Tail, err = indexChecksums(f, idx.Size); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return idx, writeIndex(indexPath(file), idx)
+}
+
+// indexChecksums returns checksums of the first and last indexCheckSize bytes of f's first size bytes
+func indexChecksums(f *os.File, size int64) (head uint32, tail uint32, err error) {
+	n := int64(indexCheckSize)
+	if size < n {
+		n = size
+	}
+	buf := make([]byte, n)
+	if _, err := f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	head = crc32.ChecksumIEEE(buf)
+	if _, err := f.ReadAt(buf, size-n); err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	return head, crc32.ChecksumIEEE(buf), nil
+}
+
+// writeIndex writes idx to path, replacing any index already there only once the new one is complete
+func writeIndex(path string, idx *fileIndex) error {
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(tmp)
+	if err := gob.NewEncoder(zw).Encode(idx); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readIndex reads the index of f, whose name is file, if it has one that's still good for it: built with
+// the same parser settings, and for a file that's only been appended to since
+func readIndex(f *os.File, file string) (*fileIndex, error) {
+	idxFile, err := os.Open(indexPath(file))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer idxFile.Close()
+
+	zr, err := gzip.NewReader(idxFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", idxFile.Name(), err)
+	}
+	idx := &fileIndex{}
+	if err := gob.NewDecoder(zr).Decode(idx); err != nil || idx.Version != indexVersion {
+		return nil, fmt.Errorf("%s: unreadable or from another version of axe; rebuild it with axe index build", idxFile.Name())
+	}
+	if idx.Format != indexFormat() {
+		return nil, fmt.Errorf("%s: built for -log-format %s; rebuild it with axe index build", idxFile.Name(), idx.Format)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	stale := info.Size() < idx.Size
+	if !stale {
+		head, tail, err := indexChecksums(f, idx.Size)
+		if err != nil {
+			return nil, err
+		}
+		stale = head != idx.Head || tail != idx.Tail
+	}
+	if stale {
+		return nil, fmt.Errorf("%s: out of date; rebuild it with axe index build", idxFile.Name())
+	}
+	return idx, nil
+}
+
+// selectBlocks returns which of idx's blocks can hold lines q allows
+func (idx *fileIndex) selectBlocks(q indexQuery) []bool {
+	selected := make([]bool, len(idx.Blocks))
+	for i, b := range idx.Blocks {
+		// blocks without times might hold anything
+		selected[i] = b.MinTime == 0 ||
+			((q.window.until.IsZero() || b.MinTime < q.window.until.UnixNano()) &&
+				(q.window.since.IsZero() || b.MaxTime >= q.window.since.UnixNano()))
+	}
+
+	// every kind of filter given narrows the blocks down further
+	narrow := func(postings map[string][]uint32, match func(key string) bool) {
+		found := make([]bool, len(idx.Blocks))
+		for key, blocks := range postings {
+			if match(key) {
+				for _, b := range blocks {
+					found[b] = true
+				}
+			}
+		}
+		for i := range selected {
+			selected[i] = selected[i] && found[i]
+		}
+	}
+	f := q.filter
+	if len(f.nets) > 0 {
+		narrow(idx.IPs, func(key string) bool { return inNets(net.ParseIP(key), f.nets) })
+	}
+	if len(f.statuses) > 0 {
+		narrow(idx.Statuses, f.matchesStatus)
+	}
+	if len(f.routes) > 0 {
+		narrow(idx.Routes, func(key string) bool { return f.routes[key] })
+	}
+	return selected
+}
+
+// readBlocks returns a reader over the selected blocks of f, followed by anything appended since it was
+// indexed
+func (idx *fileIndex) readBlocks(f *os.File, selected []bool) (io.Reader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []io.Reader
+	for i := 0; i < len(idx.Blocks); i++ {
+		if !selected[i] {
+			continue
+		}
+		// read runs of selected blocks in one go
+		j := i
+		for j+1 < len(idx.Blocks) && selected[j+1] {
+			j++
+		}
+		end := idx.Size
+		if j+1 < len(idx.Blocks) {
+			end = idx.Blocks[j+1].Offset
+		}
+		parts = append(parts, io.NewSectionReader(f, idx.Blocks[i].Offset, end-idx.Blocks[i].Offset))
+		i = j
+	}
+	parts = append(parts, io.NewSectionReader(f, idx.Size, info.Size()-idx.Size))
+	return io.MultiReader(parts...), nil
+}
+
+// narrowFile returns the parts of f, whose name is file, that can hold lines q allows: the blocks its
+// index points to if it has one, otherwise the time range found by binary search if seekParser is set.
+// Problems with the index are reported, and the file is read without it.
+func narrowFile(f *os.File, file string, seekParser func() LineParser, q indexQuery) (io.Reader, error) {
+	if q.empty() {
+		return f, nil
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return f, nil
+	}
+
+	// STDIN redirected from a file is opened as /dev/stdin; find the file's own name where the OS allows
+	if resolved, err := filepath.EvalSymlinks(file); err == nil {
+		file = resolved
+	}
+	// indexes cover whole files, so they're no use to a file that's already been read from
+	if pos, err := f.Seek(0, io.SeekCurrent); err == nil && pos == 0 && *logFormat != "w3c" {
+		idx, err := readIndex(f, file)
+		if err != nil {
+			errorFunc(fmt.Errorf("ignoring index: %v", err))
+		} else if idx != nil {
+			return idx.readBlocks(f, idx.selectBlocks(q))
+		}
+	}
+
+	if seekParser != nil && !q.window.empty() {
+		return seekTimeRange(f, seekParser, q.window)
+	}
+	return f, nil
+}
+
+// indexStats describes idx for axe index build
+func indexStats(idx *fileIndex) string {
+	var first, last int64
+	for _, b := range idx.Blocks {
+		if b.MinTime != 0 && (first == 0 || b.MinTime < first) {
+			first = b.MinTime
+		}
+		if b.MaxTime > last {
+			last = b.MaxTime
+		}
+	}
+	times := ""
+	if first != 0 {
+		times = fmt.Sprintf(", %s to %s", time.Unix(0, first).Format(time.RFC3339), time.Unix(0, last).Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%d bytes in %d blocks%s; %d IPs, %d statuses, %d routes",
+		idx.Size, len(idx.Blocks), times, len(idx.IPs), len(idx.Statuses), len(idx.Routes))
+}
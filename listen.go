@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// maxDatagramSize is the largest UDP payload we accept; nginx itself never sends more than ~2 KiB
+const maxDatagramSize = 65535
+
+// listener accepts log lines over UDP (one or more per datagram, as nginx's syslog: output sends them) and
+// newline-delimited TCP streams, and writes them to a pipe for Axe to read like STDIN
+type listener struct {
+	mu        sync.Mutex
+	w         *io.PipeWriter
+	r         *io.PipeReader
+	packets   []net.PacketConn
+	listeners []net.Listener
+	closed    bool
+}
+
+func newListener() *listener {
+	r, w := io.Pipe()
+	return &listener{r: r, w: w}
+}
+
+// listenUDP starts reading datagrams on addr
+func (l *listener) listenUDP(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l.packets = append(l.packets, pc)
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				if !l.isClosed() {
+					defaultErrFunc(fmt.Errorf("udp %s: %v", addr, err))
+				}
+				return
+			}
+			for _, line := range strings.Split(strings.TrimRight(string(buf[:n]), "\r\n"), "\n") {
+				l.writeLine(line)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// listenTCP starts accepting newline-delimited streams on addr
+func (l *listener) listenTCP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	l.listeners = append(l.listeners, ln)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !l.isClosed() {
+					defaultErrFunc(fmt.Errorf("tcp %s: %v", addr, err))
+				}
+				return
+			}
+			go l.readConn(conn)
+		}
+	}()
+
+	return nil
+}
+
+// readConn applies -max-line-length and -long-lines as lines arrive, so that a sender can't make axe hold
+// more than a line's worth of a connection in memory
+func (l *listener) readConn(conn net.Conn) {
+	defer conn.Close()
+	max := *maxLineLength
+	if *longLines == longLinesParse {
+		max = 0
+	}
+	r := bufio.NewReader(conn)
+	for {
+		line, tooLong, err := readLine(r, max)
+		if err != nil {
+			if err != io.EOF && !l.isClosed() {
+				defaultErrFunc(fmt.Errorf("tcp %s: %v", conn.RemoteAddr(), err))
+			}
+			return
+		}
+		if tooLong && *longLines == longLinesSkip {
+			defaultErrFunc(fmt.Errorf("tcp %s: line longer than %d bytes skipped", conn.RemoteAddr(), *maxLineLength))
+			continue
+		}
+		l.writeLine(line)
+	}
+}
+
+// writeLine hands a single line to the reading side of the pipe; lines from different senders never interleave
+func (l *listener) writeLine(line string) {
+	if line == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	if _, err := io.WriteString(l.w, line+"\n"); err != nil {
+		l.closed = true
+	}
+}
+
+func (l *listener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// close stops all listeners and ends the stream, letting Axe finish and print any summary
+func (l *listener) close() {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+
+	for _, pc := range l.packets {
+		pc.Close()
+	}
+	for _, ln := range l.listeners {
+		ln.Close()
+	}
+	l.w.Close()
+}
+
+// announce tells the user where we're listening, on STDERR so it doesn't mix with command output
+func (l *listener) announce() {
+	for _, pc := range l.packets {
+		fmt.Fprintf(os.Stderr, "listening on udp %s\n", pc.LocalAddr())
+	}
+	for _, ln := range l.listeners {
+		fmt.Fprintf(os.Stderr, "listening on tcp %s\n", ln.Addr())
+	}
+}
@@ -20,7 +20,49 @@ type LogLine struct {
 	Referer   *url.URL
 	UserAgent string
 
+	// ForwardedFor holds the addresses from a logged X-Forwarded-For or Forwarded header, leftmost first;
+	// entries that weren't addresses are nil
+	ForwardedFor []net.IP
+	// Peer is the address that connected to the server, when -trusted-proxies replaced IP with the client's
+	Peer net.IP
+
+	// RequestTime is the time taken to serve the request, if logged
+	RequestTime time.Duration
+
+	// HAProxy holds the HAProxy-specific values, if the line came from HAProxy
+	HAProxy *HAProxyInfo
+	// ErrorLog holds the error-specific values, if the line came from an nginx error log
+	ErrorLog *ErrorLine
+	// Syslog holds the syslog header values, if the line arrived wrapped in one
+	Syslog *SyslogInfo
+	// Geo holds GeoIP / ASN details for IP, if databases were given and knew about it
+	Geo *GeoInfo
+	// Source names the file the line came from when several were merged with -merge
+	Source string
+
+	// Raw is the line exactly as it was read
+	Raw string
+
 	Error error
+
+	// spans records where in Raw each parsed value came from, for writers that rewrite lines in place
+	spans []span
+	// directives holds lines the parser consumed on the way to this one (e.g. W3C #Fields), in order
+	directives []string
+}
+
+// span is the part of a raw line that one value was parsed from
+type span struct {
+	valueType  string
+	start, end int
+}
+
+// shiftSpans moves the spans n bytes to the right, for parsers that strip a prefix before parsing
+func (l *LogLine) shiftSpans(n int) {
+	for i := range l.spans {
+		l.spans[i].start += n
+		l.spans[i].end += n
+	}
 }
 
 // TODO: make this customizable
@@ -48,6 +90,41 @@ func (l *LogLine) String() string {
 	)
 }
 
+// request returns l.Request, creating it first if the line's request is logged piecemeal
+func (l *LogLine) request() *http.Request {
+	if l.Request == nil {
+		l.Request = &http.Request{
+			Method:     http.MethodGet,
+			URL:        &url.URL{},
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+		}
+	}
+	return l.Request
+}
+
+// addSpan records where the items of a value of type valueType were found, unless any went missing
+func (l *LogLine) addSpan(valueType string, items []item) {
+	if len(items) == 0 {
+		return
+	}
+	s := span{valueType: valueType, start: items[0].pos}
+	for _, it := range items {
+		if it.typ == itemError {
+			return
+		}
+		if it.pos < s.start {
+			s.start = it.pos
+		}
+		if end := it.pos + len(it.val); end > s.end {
+			s.end = end
+		}
+	}
+	l.spans = append(l.spans, s)
+}
+
 func (l *LogLine) invalidValueErr(ok bool, input value) bool {
 	if !ok {
 		l.Error = fmt.Errorf("invalid %s: %v", input.valueType, input.obj)
@@ -63,11 +140,49 @@ func (l *LogLine) add(input value) *LogLine {
 		if !l.invalidValueErr(ok, input) {
 			l.BodyBytes = bodyBytes
 		}
+	case ValueClock:
+		c, ok := input.obj.(time.Time)
+		if !l.invalidValueErr(ok, input) {
+			t := l.Time
+			l.Time = time.Date(t.Year(), t.Month(), t.Day(), c.Hour(), c.Minute(), c.Second(), c.Nanosecond(), time.UTC)
+		}
+	case ValueDate:
+		d, ok := input.obj.(time.Time)
+		if !l.invalidValueErr(ok, input) {
+			t := l.Time
+			l.Time = time.Date(d.Year(), d.Month(), d.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+		}
+	case ValueErrorLevel, ValueErrorMessage, ValueErrorProcess:
+		l.addError(input)
+	case ValueForwardedFor:
+		hops, ok := input.obj.([]net.IP)
+		if !l.invalidValueErr(ok, input) {
+			l.ForwardedFor = hops
+		}
+	case ValueHAProxyBackend, ValueHAProxyClient, ValueHAProxyConns, ValueHAProxyFrontend, ValueHAProxyQueues,
+		ValueHAProxyRequestHeaders, ValueHAProxyResponseHeaders, ValueHAProxyTermination, ValueHAProxyTimers:
+		l.addHAProxy(input)
+	case ValueHost:
+		host, ok := input.obj.(string)
+		if !l.invalidValueErr(ok, input) {
+			l.request().Host = host
+		}
 	case ValueIP:
 		ip, ok := input.obj.(net.IP)
 		if !l.invalidValueErr(ok, input) {
 			l.IP = ip
 		}
+	case ValueMethod:
+		method, ok := input.obj.(string)
+		if !l.invalidValueErr(ok, input) {
+			l.request().Method = method
+		}
+	case ValueProto:
+		req, ok := input.obj.(*http.Request)
+		if !l.invalidValueErr(ok, input) {
+			r := l.request()
+			r.Proto, r.ProtoMajor, r.ProtoMinor = req.Proto, req.ProtoMajor, req.ProtoMinor
+		}
 	case ValueReferer:
 		u, ok := input.obj.(*url.URL)
 		if !l.invalidValueErr(ok, input) {
@@ -78,6 +193,11 @@ func (l *LogLine) add(input value) *LogLine {
 		if !l.invalidValueErr(ok, input) {
 			l.Request = req
 		}
+	case ValueRequestTime:
+		d, ok := input.obj.(time.Duration)
+		if !l.invalidValueErr(ok, input) {
+			l.RequestTime = d
+		}
 	case ValueStatus:
 		status, ok := input.obj.(int64)
 		if !l.invalidValueErr(ok, input) {
@@ -88,6 +208,16 @@ func (l *LogLine) add(input value) *LogLine {
 		if !l.invalidValueErr(ok, input) {
 			l.Time = t
 		}
+	case ValueURIQuery:
+		query, ok := input.obj.(string)
+		if !l.invalidValueErr(ok, input) {
+			l.request().URL.RawQuery = query
+		}
+	case ValueURIStem:
+		path, ok := input.obj.(string)
+		if !l.invalidValueErr(ok, input) {
+			l.request().URL.Path = path
+		}
 	case ValueUser:
 		user, ok := input.obj.(string)
 		if !l.invalidValueErr(ok, input) {
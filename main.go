@@ -1,16 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
+	"time"
 )
 
 // TODO: allow parsing from file
 // TODO: "fast" mode - don't care about interleaving lines, more workers
 // TODO: ability to suppress errors?
 func defaultPrintFunc(l *LogLine) {
+	if l.Source != "" {
+		fmt.Printf("%s\t%s\n", l.Source, l.String())
+		return
+	}
 	fmt.Println(l.String())
 }
 
@@ -23,38 +32,292 @@ func defaultErrFunc(err error) {
 
 var cmdList = commands{}
 
-func parseCLI(args []string) llFunc {
+// input is where lines are read from; commands like listen replace it
+var input io.Reader = os.Stdin
+
+// errorFunc reports problems with lines and inputs; commands that take over the terminal replace it
+var errorFunc errFunc = defaultErrFunc
+
+// beforeStart, if set, runs once every option has been checked, just before lines are read; commands
+// that take over the terminal use it so that errors in the options are still printed normally
+var beforeStart func() error
+
+// stopReading ends the input early, as though every file had been read, once a command has all the lines
+// it wants
+var readCtx, stopReading = context.WithCancel(context.Background())
+
+// summaryInterval, if set, prints the command's summary periodically as well as at the end
+var summaryInterval time.Duration
+
+// mergeFiles are the files named before the command with -merge
+var mergeFiles []string
+
+var syslogHeaders = flag.Bool("syslog", false, "strip RFC 3164 / RFC 5424 syslog headers before parsing each line")
+var maxLineLength = flag.Int("max-line-length", defaultMaxLineLength, "longest line, in bytes, to read in full")
+var longLines = flag.String("long-lines", longLinesSkip, fmt.Sprintf(
+	"what to do with lines longer than -max-line-length (%s, %s, %s)", longLinesTruncate, longLinesSkip, longLinesParse,
+))
+var geoipFile = flag.String("geoip", "", "MaxMind city or country database (.mmdb) to look up each IP's location in")
+var asnFile = flag.String("asn", "", "MaxMind ASN database (.mmdb) to look up each IP's network in")
+var onlyCountries = flag.String("country", "", "only process lines from these comma-separated country codes (needs -geoip)")
+var onlyASNs = flag.String("as-number", "", "only process lines from these comma-separated AS numbers (needs -asn)")
+var trustedProxies = flag.String("trusted-proxies", "", "comma-separated IPs and CIDRs of proxies whose X-Forwarded-For / Forwarded entries to believe when finding the client IP")
+var since = flag.String("since", "", "only process lines from this time on: 2006-01-02T15:04:05, 2006-01-02 15:04, or a duration ago like -2h")
+var until = flag.String("until", "", "only process lines from before this time, in the same forms as -since")
+var onlyIPs = flag.String("ip", "", "only process lines from these comma-separated IPs and CIDRs")
+var onlyStatuses = flag.String("status", "", "only process lines with these comma-separated statuses, e.g. 404,5xx")
+var onlyRoutes = flag.String("route", "", "only process requests for these comma-separated routes, as paths -template prints them, e.g. /users/{id}")
+var merge = flag.Bool("merge", false, "read the log files named before the command, merging their lines in time order and tagging each with its file's name")
+var mergeTolerance = flag.Duration("merge-tolerance", defaultMergeTolerance, "how far out of time order lines within one -merge file may be")
+var logFormat = flag.String("log-format", "combined", fmt.Sprintf("format of the input logs (%s)", strings.Join(logFormatNames(), ", ")))
+
+func parseCLI(args []string) (llFunc, summaryFunc) {
 	cmd := ""
 	cmdArgs := []string{}
 
-	if len(args) == 1 {
-		return defaultPrintFunc
-	} else if len(args) > 1 {
-		cmd = args[1]
-		if len(args) > 2 {
-			cmdArgs = args[2:]
+	// global options come before the command; flag.ExitOnError means we never see an error here
+	_ = flag.CommandLine.Parse(args[1:])
+
+	rest := flag.Args()
+	if *merge {
+		// files run up to the first argument that names a command
+		for len(rest) > 0 && cmdList.find(rest[0]) == nil {
+			mergeFiles = append(mergeFiles, rest[0])
+			rest = rest[1:]
 		}
 	}
-
-	flag.Parse()
+	if len(rest) == 0 {
+		return defaultPrintFunc, nil
+	}
+	cmd = rest[0]
+	if len(rest) > 1 {
+		cmdArgs = rest[1:]
+	}
 
 	if c := cmdList.find(cmd); c != nil {
 		pf, err := c.execute(cmdArgs)
 		if err != nil {
 			log.Fatalf("error: %v", err)
 		}
-		return pf
+		return pf, c.sf
 	}
 
 	flag.Usage()
 	fmt.Printf("Command not found: %s\n", cmd)
 	os.Exit(1)
 
+	return nil, nil
+}
+
+// baseParser returns the parser for -log-format and -syslog, before anything that looks up extra details
+func baseParser() (func() LineParser, error) {
+	newParser, ok := logFormats[*logFormat]
+	if !ok {
+		return nil, fmt.Errorf("unknown log format: %s", *logFormat)
+	}
+	if *syslogHeaders {
+		newParser = withSyslog(newParser)
+	}
+	return newParser, nil
+}
+
+// checkLongLines checks -long-lines and -max-line-length
+func checkLongLines() error {
+	switch *longLines {
+	case longLinesTruncate, longLinesSkip, longLinesParse:
+	default:
+		return fmt.Errorf("unknown -long-lines policy: %s", *longLines)
+	}
+	if *maxLineLength <= 0 {
+		return fmt.Errorf("-max-line-length must be positive")
+	}
 	return nil
 }
 
+// lineParsers returns the parser for every line, which finds the client behind -trusted-proxies and looks
+// it up in the GeoIP databases, and the plain parser used to find timestamps when seeking, which is nil for
+// formats that can't be read from the middle
+func lineParsers() (newParser func() LineParser, seekParser func() LineParser, err error) {
+	if newParser, err = baseParser(); err != nil {
+		return nil, nil, err
+	}
+	// W3C files can't be read from the middle, since the columns are defined by #Fields further up
+	if *logFormat != "w3c" {
+		seekParser = newParser
+	}
+	if *trustedProxies != "" {
+		trusted, err := parseNetList(*trustedProxies)
+		if err != nil {
+			return nil, nil, fmt.Errorf("-trusted-proxies: %v", err)
+		}
+		newParser = withTrustedProxies(newParser, trusted)
+	}
+	if *geoipFile != "" || *asnFile != "" {
+		dbs, err := openGeoDatabases(*geoipFile, *asnFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		newParser = withGeoIP(newParser, dbs)
+	}
+	return newParser, seekParser, nil
+}
+
+// lineSelection picks the lines to process by time, IP, status, route, country and network
+type lineSelection struct {
+	window timeRange
+	filter *lineFilter
+	geo    *geoFilter
+}
+
+// lineSelectionOptions are the global options parsed into a lineSelection, which serve also takes as query
+// parameters
+var lineSelectionOptions = []string{"since", "until", "ip", "status", "route", "country", "as-number"}
+
+// parseLineSelection parses the values of lineSelectionOptions returned by get; errors name the option
+// with prefix, e.g. "-" for flags
+func parseLineSelection(get func(name string) string, prefix string, now time.Time) (*lineSelection, error) {
+	sel := &lineSelection{}
+	var err error
+	if v := get("since"); v != "" {
+		if sel.window.since, err = parseTimeBound(v, now); err != nil {
+			return nil, fmt.Errorf("%ssince: %v", prefix, err)
+		}
+	}
+	if v := get("until"); v != "" {
+		if sel.window.until, err = parseTimeBound(v, now); err != nil {
+			return nil, fmt.Errorf("%suntil: %v", prefix, err)
+		}
+	}
+	if sel.filter, err = parseLineFilter(get("ip"), get("status"), get("route")); err != nil {
+		return nil, err
+	}
+	if sel.geo, err = parseGeoFilter(get("country"), get("as-number")); err != nil {
+		return nil, err
+	}
+	if len(sel.geo.countries) > 0 && *geoipFile == "" {
+		return nil, fmt.Errorf("%scountry needs -geoip", prefix)
+	}
+	if len(sel.geo.asns) > 0 && *asnFile == "" {
+		return nil, fmt.Errorf("%sas-number needs -asn", prefix)
+	}
+	return sel, nil
+}
+
+func (sel *lineSelection) empty() bool {
+	return sel.window.empty() && sel.filter.empty() && sel.geo.empty()
+}
+
+// wrap returns a printFunc that passes the selected lines on to next
+func (sel *lineSelection) wrap(next llFunc) llFunc {
+	if sel.empty() {
+		return next
+	}
+	return func(ll *LogLine) {
+		if sel.filter.matches(ll) && (sel.geo.empty() || sel.geo.matches(ll)) && sel.window.contains(ll.Time) {
+			next(ll)
+		}
+	}
+}
+
+// indexQuery is the part of the selection that indexes and binary search can narrow files down by
+func (sel *lineSelection) indexQuery() indexQuery {
+	return indexQuery{window: sel.window, filter: sel.filter}
+}
+
 func main() {
-	printFunc := parseCLI(os.Args)
-	axe := NewAxe(1, printFunc, defaultErrFunc)
-	axe.Start()
+	printFunc, summary := parseCLI(os.Args)
+	// commands without a print func, like index, have done all their work already
+	if printFunc == nil {
+		return
+	}
+
+	newParser, seekParser, err := lineParsers()
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	sel, err := parseLineSelection(func(name string) string {
+		return flag.Lookup(name).Value.String()
+	}, "-", time.Now())
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	printFunc = sel.wrap(printFunc)
+	query := sel.indexQuery()
+	if f, ok := input.(*os.File); ok && !*merge {
+		if input, err = narrowFile(f, f.Name(), seekParser, query); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+	}
+	var sources []*mergeSource
+	if *merge {
+		if len(mergeFiles) == 0 {
+			log.Fatalf("error: -merge needs at least one file before the command")
+		}
+		if input != os.Stdin {
+			log.Fatalf("error: -merge can't be used with a command that reads its own input")
+		}
+		if *mergeTolerance < 0 {
+			log.Fatalf("error: -merge-tolerance must not be negative")
+		}
+		for _, file := range mergeFiles {
+			s, err := openMergeSource(file, seekParser, query)
+			if err != nil {
+				log.Fatalf("error: %v", err)
+			}
+			s.reader = &contextReader{ctx: readCtx, r: s.reader}
+			sources = append(sources, s)
+		}
+	}
+	if err := checkLongLines(); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+
+	axe := NewAxe(1, &contextReader{ctx: readCtx, r: input}, newParser, printFunc, errorFunc)
+	axe.setLongLines(*maxLineLength, *longLines)
+	if len(sources) > 0 {
+		axe.merge(sources, *mergeTolerance)
+	}
+	if summary != nil && summaryInterval > 0 {
+		axe.every(summaryInterval, func() {
+			fmt.Printf("# %s\n", time.Now().Format(time.RFC3339))
+			summary()
+		})
+	}
+	if beforeStart != nil {
+		if err := beforeStart(); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+	}
+	readErr := axe.Start()
+
+	if summary != nil {
+		summary()
+	}
+
+	// the error itself has already been reported with the line it happened on
+	if readErr != nil {
+		os.Exit(1)
+	}
+}
+
+// contextReader ends at the first line break once ctx is done, as though r ended there, so that no
+// partial line is left to be reported as invalid
+type contextReader struct {
+	ctx   context.Context
+	r     io.Reader
+	ended bool
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if r.ended {
+		return 0, io.EOF
+	}
+	n, err := r.r.Read(p)
+	if r.ctx.Err() != nil {
+		if i := bytes.IndexByte(p[:n], '\n'); i >= 0 {
+			r.ended = true
+			return i + 1, nil
+		}
+	}
+	return n, err
 }
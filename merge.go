@@ -0,0 +1,195 @@
+package main
+
+import (
+	"compress/gzip"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultMergeTolerance is how far out of order lines within one file can be and still be merged in order;
+// nginx logs a request when it finishes, with the time it started, so slow requests land late
+const defaultMergeTolerance = 5 * time.Second
+
+// mergeSource is one file being merged with the others
+type mergeSource struct {
+	name   string
+	file   *os.File
+	reader io.Reader
+	lines  chan *LogLine
+	err    error
+
+	// latest is the latest time read from the file so far; done is set once it's been read to the end
+	latest time.Time
+	done   bool
+}
+
+// sourceName names the host a file's lines came from: its base name without .gz and .log, so
+// /var/log/web1.log.gz is web1
+func sourceName(file string) string {
+	name := filepath.Base(file)
+	name = strings.TrimSuffix(name, ".gz")
+	name = strings.TrimSuffix(name, ".log")
+	return name
+}
+
+// openMergeSource opens file for merging, decompressing it if it ends in .gz. Uncompressed files are cut
+// down to what q allows with narrowFile.
+func openMergeSource(file string, seekParser func() LineParser, q indexQuery) (*mergeSource, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	s := &mergeSource{name: sourceName(file), file: f, reader: f, lines: make(chan *LogLine, 1024)}
+
+	switch {
+	case strings.HasSuffix(file, ".gz"):
+		if s.reader, err = gzip.NewReader(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	default:
+		if s.reader, err = narrowFile(f, file, seekParser, q); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return s, nil
+}
+
+// merge has a read sources instead of its source, interleaving their lines by time. Lines up to
+// tolerance out of order within a source are still put in order.
+func (a *Axe) merge(sources []*mergeSource, tolerance time.Duration) {
+	a.sources = sources
+	a.tolerance = tolerance
+}
+
+// startMerge starts a reader and parser for each source, and the worker that merges their lines
+func (a *Axe) startMerge() {
+	for _, s := range a.sources {
+		raw := make(chan rawLine, 1024)
+		a.wg.Add(2)
+		go func(s *mergeSource) {
+			defer a.wg.Done()
+			defer close(raw)
+			s.err = a.readLines(s.reader, raw)
+			s.file.Close()
+		}(s)
+		go a.sourceWorker(s, raw, a.wg.Done)
+	}
+
+	a.wg.Add(1)
+	go a.mergeWorker(a.wg.Done)
+}
+
+// sourceWorker parses one source's lines with a parser of its own, since parsers like W3C's keep state
+// from earlier lines, and tags each with the source's name
+func (a *Axe) sourceWorker(s *mergeSource, raw <-chan rawLine, done func()) {
+	defer done()
+	defer close(s.lines)
+	parser := a.newParser()
+	lineNum := 0
+	for input := range raw {
+		a.incrNumLines()
+		lineNum++
+		if input.err != nil {
+			a.errChan <- fmt.Errorf("%s:%d:%v", s.name, lineNum, input.err)
+			continue
+		}
+		ll, err := parser.ParseLine(input.text)
+		if err != nil {
+			a.errChan <- fmt.Errorf("%s:%d:%v", s.name, lineNum, err)
+		} else if ll != nil {
+			ll.Raw = input.text
+			ll.Source = s.name
+			s.lines <- ll
+		}
+	}
+}
+
+// mergeWorker interleaves the sources' lines by time. It always reads from the source that's furthest
+// behind, and lets the earliest line waiting go once every source that's still open has moved tolerance
+// past it, so lines only wait about as long as tolerance.
+func (a *Axe) mergeWorker(done func()) {
+	defer done()
+	defer close(a.outChan)
+
+	waiting := &mergeHeap{}
+	seq := 0
+	for {
+		var behind *mergeSource
+		for _, s := range a.sources {
+			if !s.done && (behind == nil || s.latest.Before(behind.latest)) {
+				behind = s
+			}
+		}
+
+		if waiting.Len() > 0 {
+			next := (*waiting)[0]
+			if behind == nil || !behind.latest.Before(next.time.Add(a.tolerance)) {
+				a.outChan <- heap.Pop(waiting).(mergedLine).ll
+				continue
+			}
+		}
+		if behind == nil {
+			break
+		}
+
+		ll, ok := <-behind.lines
+		if !ok {
+			behind.done = true
+			continue
+		}
+		// lines without a time stay where they were in their file
+		t := ll.Time
+		if t.IsZero() {
+			t = behind.latest
+		}
+		if t.After(behind.latest) {
+			behind.latest = t
+		}
+		heap.Push(waiting, mergedLine{ll: ll, time: t, seq: seq})
+		seq++
+	}
+
+	for _, s := range a.sources {
+		if s.err != nil {
+			a.readErr = s.err
+			break
+		}
+	}
+}
+
+// mergedLine is a line waiting to be merged; seq keeps lines with the same time in the order they were read
+type mergedLine struct {
+	ll   *LogLine
+	time time.Time
+	seq  int
+}
+
+// mergeHeap is a container/heap of the lines waiting to be merged, earliest first
+type mergeHeap []mergedLine
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if !h[i].time.Equal(h[j].time) {
+		return h[i].time.Before(h[j].time)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergedLine)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+)
+
+// This is a reader for MaxMind DB (.mmdb) files such as GeoLite2-City and GeoLite2-ASN, following
+// https://maxmind.github.io/MaxMind-DB/. The whole file is read into memory and only ever read from, so one
+// *mmdbReader can be shared between goroutines. Maps decode to map[string]interface{}, arrays to
+// []interface{}, unsigned integers to uint64, int32s to int64, uint128s to *big.Int, and floats to float64.
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdb data section types
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBoolean
+	mmdbFloat
+)
+
+type mmdbReader struct {
+	path         string
+	buf          []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	databaseType string
+	dataStart    uint
+	ipv4Start    uint
+}
+
+// openMMDB reads the database at path
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newMMDBReader(path, buf)
+}
+
+// newMMDBReader reads the database in buf, which was read from path
+func newMMDBReader(path string, buf []byte) (*mmdbReader, error) {
+	metaStart := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if metaStart < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+	metaStart += len(mmdbMetadataMarker)
+
+	d := mmdbDecoder{buf: buf, base: uint(metaStart)}
+	meta, _, err := d.decode(uint(metaStart), 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: metadata: %v", path, err)
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: metadata isn't a map", path)
+	}
+
+	r := &mmdbReader{path: path, buf: buf}
+	r.nodeCount, _ = mmdbUint(m["node_count"])
+	r.recordSize, _ = mmdbUint(m["record_size"])
+	r.ipVersion, _ = mmdbUint(m["ip_version"])
+	r.databaseType, _ = m["database_type"].(string)
+
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, r.recordSize)
+	}
+	treeSize := r.recordSize * 2 / 8 * r.nodeCount
+	if treeSize+16 > uint(metaStart) {
+		return nil, fmt.Errorf("%s: search tree runs past the end of the file", path)
+	}
+	r.dataStart = treeSize + 16
+
+	// IPv4 addresses live under ::/96 in IPv6 trees
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// mmdbUint reads an unsigned integer out of decoded metadata
+func mmdbUint(v interface{}) (uint, bool) {
+	n, ok := v.(uint64)
+	return uint(n), ok
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	b := r.buf
+	switch r.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(b[off+3]&0xf0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+		return uint(b[off+3]&0x0f)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(b[off:]))
+	}
+}
+
+// lookup returns the record for ip, or nil if the database has nothing for it
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	addr := ip.To4()
+	if addr != nil && r.ipVersion == 6 {
+		node = r.ipv4Start
+	} else if addr == nil {
+		if r.ipVersion == 4 {
+			return nil, nil
+		}
+		addr = ip.To16()
+	}
+
+	for i := 0; i < len(addr)*8 && node < r.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+
+	switch {
+	case node == r.nodeCount:
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, fmt.Errorf("%s: invalid search tree", r.path)
+	}
+
+	d := mmdbDecoder{buf: r.buf, base: r.dataStart}
+	offset := r.dataStart + node - r.nodeCount - 16
+	v, _, err := d.decode(offset, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", r.path, err)
+	}
+	return v, nil
+}
+
+// mmdbDecoder decodes values from the data section, which starts at base; pointers are relative to it
+type mmdbDecoder struct {
+	buf  []byte
+	base uint
+}
+
+// maxMMDBDepth guards against corrupt files sending the decoder round in circles
+const maxMMDBDepth = 32
+
+// decode returns the value at offset and the offset just past it
+func (d mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxMMDBDepth {
+		return nil, 0, fmt.Errorf("data nested too deeply")
+	}
+	if offset >= uint(len(d.buf)) {
+		return nil, 0, fmt.Errorf("data offset %d out of range", offset)
+	}
+
+	ctrl := d.buf[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+
+	if typ == mmdbPointer {
+		target, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(target, depth+1)
+		return v, next, err
+	}
+
+	if typ == mmdbExtended {
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, fmt.Errorf("truncated data")
+		}
+		typ = 7 + uint(d.buf[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.buf)) {
+			return nil, 0, fmt.Errorf("truncated data")
+		}
+		extra := uint(0)
+		for _, b := range d.buf[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		offset += n
+		switch size {
+		case 29:
+			size = 29 + extra
+		case 30:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+
+	// every entry takes at least a byte, so a corrupt size can't make us allocate more than the file
+	if (typ == mmdbMap || typ == mmdbArray) && size > uint(len(d.buf))-offset {
+		return nil, 0, fmt.Errorf("truncated data")
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key isn't a string")
+			}
+			v, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBoolean:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, fmt.Errorf("truncated data")
+	}
+	raw := d.buf[offset : offset+size]
+	next := offset + size
+
+	switch typ {
+	case mmdbString:
+		return string(raw), next, nil
+	case mmdbBytes:
+		return append([]byte(nil), raw...), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+		n := uint64(0)
+		for _, b := range raw {
+			n = n<<8 | uint64(b)
+		}
+		return n, next, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+		n := uint32(0)
+		for _, b := range raw {
+			n = n<<8 | uint32(b)
+		}
+		return int64(int32(n)), next, nil
+	case mmdbUint128:
+		return new(big.Int).SetBytes(raw), next, nil
+	}
+
+	return nil, 0, fmt.Errorf("unknown data type %d", typ)
+}
+
+// pointer returns the absolute offset a pointer refers to, and the offset just past the pointer
+func (d mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&0x3 + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, fmt.Errorf("truncated pointer")
+	}
+	p := uint(0)
+	if n < 4 {
+		p = uint(ctrl & 0x7)
+	}
+	for _, b := range d.buf[offset : offset+n] {
+		p = p<<8 | uint(b)
+	}
+	switch n {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+	return d.base + p, offset + n, nil
+}
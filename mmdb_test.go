@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// mmdbBuilder writes small MaxMind DB files: an IPv6 search tree with 24-bit records, then the data
+// section, then the metadata
+type mmdbBuilder struct {
+	// nodes hold each node's two records: a node index, mmdbEmpty, or mmdbData(offset)
+	nodes [][2]int
+	data  []byte
+}
+
+const mmdbEmpty = -1
+
+func mmdbData(offset int) int { return -2 - offset }
+
+// mmdbCtrl encodes a control byte, with the extended type and size bytes that follow it; sizes must be
+// under 285
+func mmdbCtrl(typ byte, size int) []byte {
+	var b []byte
+	if typ > 7 {
+		b = []byte{0, typ - 7}
+	} else {
+		b = []byte{typ << 5}
+	}
+	if size < 29 {
+		b[0] |= byte(size)
+		return b
+	}
+	b[0] |= 29
+	return append(b, byte(size-29))
+}
+
+func mmdbTestString(s string) []byte {
+	return append(mmdbCtrl(mmdbString, len(s)), s...)
+}
+
+func mmdbTestUint32(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return append(mmdbCtrl(mmdbUint32, 4), b...)
+}
+
+// mmdbTestPointer points at offset in the data section, which must be under 2048
+func mmdbTestPointer(offset int) []byte {
+	return []byte{mmdbPointer<<5 | byte(offset>>8), byte(offset)}
+}
+
+// mmdbTestMap encodes a map from alternating keys and encoded values
+func mmdbTestMap(pairs ...interface{}) []byte {
+	b := mmdbCtrl(mmdbMap, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		b = append(b, mmdbTestString(pairs[i].(string))...)
+		b = append(b, pairs[i+1].([]byte)...)
+	}
+	return b
+}
+
+// add appends an encoded value to the data section, returning its offset
+func (m *mmdbBuilder) add(value []byte) int {
+	offset := len(m.data)
+	m.data = append(m.data, value...)
+	return offset
+}
+
+// insert points the network ip/bits at the data at offset
+func (m *mmdbBuilder) insert(ip net.IP, bits int, offset int) {
+	if len(m.nodes) == 0 {
+		m.nodes = append(m.nodes, [2]int{mmdbEmpty, mmdbEmpty})
+	}
+	addr := ip.To16()
+	node := 0
+	for i := 0; i < bits; i++ {
+		bit := addr[i/8] >> (7 - uint(i%8)) & 1
+		if i == bits-1 {
+			m.nodes[node][bit] = mmdbData(offset)
+			break
+		}
+		if m.nodes[node][bit] < 0 {
+			m.nodes = append(m.nodes, [2]int{mmdbEmpty, mmdbEmpty})
+			m.nodes[node][bit] = len(m.nodes) - 1
+		}
+		node = m.nodes[node][bit]
+	}
+}
+
+func (m *mmdbBuilder) bytes() []byte {
+	var b bytes.Buffer
+	count := len(m.nodes)
+	for _, records := range m.nodes {
+		for _, r := range records {
+			v := r
+			switch {
+			case r == mmdbEmpty:
+				v = count
+			case r < 0:
+				v = count + 16 + (-2 - r)
+			}
+			b.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	b.Write(make([]byte, 16))
+	b.Write(m.data)
+	b.Write(mmdbMetadataMarker)
+	b.Write(mmdbTestMap(
+		"node_count", mmdbTestUint32(uint32(count)),
+		"record_size", mmdbTestUint32(24),
+		"ip_version", mmdbTestUint32(6),
+		"database_type", mmdbTestString("Test"),
+	))
+	return b.Bytes()
+}
+
+func testMMDB() []byte {
+	m := &mmdbBuilder{}
+	org := m.add(mmdbTestString("Example Net"))
+	au := m.add(mmdbTestMap("country", mmdbTestMap("iso_code", mmdbTestString("AU"))))
+	// the organization is stored once and pointed to, as real databases do
+	as := m.add(mmdbTestMap(
+		"autonomous_system_number", mmdbTestUint32(64500),
+		"autonomous_system_organization", mmdbTestPointer(org),
+	))
+	m.insert(net.ParseIP("::1.2.3.0"), 96+24, au)
+	m.insert(net.ParseIP("2001:db8::"), 32, as)
+	return m.bytes()
+}
+
+func TestMMDBLookup(t *testing.T) {
+	r, err := newMMDBReader("test.mmdb", testMMDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.databaseType != "Test" || r.ipVersion != 6 || r.recordSize != 24 {
+		t.Fatalf("metadata: type %q, IP version %d, record size %d", r.databaseType, r.ipVersion, r.recordSize)
+	}
+
+	tests := []struct {
+		ip   string
+		want interface{}
+	}{
+		{"1.2.3.4", map[string]interface{}{"country": map[string]interface{}{"iso_code": "AU"}}},
+		{"1.2.4.4", nil},
+		{"2001:db8:1::5", map[string]interface{}{
+			"autonomous_system_number":       uint64(64500),
+			"autonomous_system_organization": "Example Net",
+		}},
+		{"2001:db9::1", nil},
+	}
+	for _, test := range tests {
+		got, err := r.lookup(net.ParseIP(test.ip))
+		if err != nil {
+			t.Errorf("%s: %v", test.ip, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestMMDBMalformed(t *testing.T) {
+	db := testMMDB()
+	meta := bytes.LastIndex(db, mmdbMetadataMarker)
+
+	// a file cut off anywhere fails to open, or fails lookups, rather than panicking
+	for n := 0; n < len(db); n++ {
+		r, err := newMMDBReader("test.mmdb", db[:n])
+		if err != nil {
+			continue
+		}
+		for _, ip := range []string{"1.2.3.4", "2001:db8::1"} {
+			_, _ = r.lookup(net.ParseIP(ip))
+		}
+	}
+	if _, err := newMMDBReader("test.mmdb", db[:meta]); err == nil {
+		t.Error("opened a file without metadata")
+	}
+
+	// data the tree points to that isn't there
+	m := &mmdbBuilder{}
+	m.insert(net.ParseIP("2001:db8::"), 32, 1000)
+	r, err := newMMDBReader("test.mmdb", m.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.lookup(net.ParseIP("2001:db8::1")); err == nil {
+		t.Error("no error for a record past the end of the data")
+	}
+
+	// a map claiming far more entries than the file holds
+	m = &mmdbBuilder{}
+	huge := m.add([]byte{mmdbMap<<5 | 31, 0xff, 0xff, 0xff})
+	m.insert(net.ParseIP("2001:db8::"), 32, huge)
+	if r, err = newMMDBReader("test.mmdb", m.bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.lookup(net.ParseIP("2001:db8::1")); err == nil {
+		t.Error("no error for a truncated map")
+	}
+
+	// pointers that point at themselves
+	m = &mmdbBuilder{}
+	loop := m.add(mmdbTestPointer(0))
+	m.insert(net.ParseIP("2001:db8::"), 32, loop)
+	if r, err = newMMDBReader("test.mmdb", m.bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.lookup(net.ParseIP("2001:db8::1")); err == nil {
+		t.Error("no error for a pointer loop")
+	}
+}
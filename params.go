@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// maxParamValues caps how many distinct values are remembered per query parameter
+const maxParamValues = 10000
+
+// entropy returns the Shannon entropy of s in bits per byte
+func entropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	var freq [256]int
+	for i := 0; i < len(s); i++ {
+		freq[s[i]]++
+	}
+	result := 0.0
+	n := float64(len(s))
+	for _, f := range freq {
+		if f > 0 {
+			p := float64(f) / n
+			result -= p * math.Log2(p)
+		}
+	}
+	return result
+}
+
+// paramStats accumulates what's been seen of one query parameter
+type paramStats struct {
+	key        string
+	count      int
+	values     map[string]int
+	overflow   bool
+	suspicious int
+}
+
+// paramSummary tallies query parameters across requests and picks out suspicious values
+type paramSummary struct {
+	maxLength  int
+	minEntropy float64
+	params     map[string]*paramStats
+}
+
+func newParamSummary() *paramSummary {
+	return &paramSummary{params: map[string]*paramStats{}}
+}
+
+// minEntropyLength keeps short values, whose entropy means little, from being flagged
+const minEntropyLength = 20
+
+// suspicion says why value stands out, or returns "" if it doesn't
+func (p *paramSummary) suspicion(value string) string {
+	if p.maxLength > 0 && len(value) > p.maxLength {
+		return fmt.Sprintf("long (%d bytes)", len(value))
+	}
+	if p.minEntropy > 0 && len(value) >= minEntropyLength {
+		if e := entropy(value); e >= p.minEntropy {
+			return fmt.Sprintf("high entropy (%.1f bits/byte)", e)
+		}
+	}
+	return ""
+}
+
+// add records a parameter; it returns why the value is suspicious, or ""
+func (p *paramSummary) add(key string, value string) string {
+	s, ok := p.params[key]
+	if !ok {
+		s = &paramStats{key: key, values: map[string]int{}}
+		p.params[key] = s
+	}
+	s.count++
+	if _, seen := s.values[value]; seen || len(s.values) < maxParamValues {
+		s.values[value]++
+	} else {
+		s.overflow = true
+	}
+
+	reason := p.suspicion(value)
+	if reason != "" {
+		s.suspicious++
+	}
+	return reason
+}
+
+// write prints each parameter with how often it appeared, how many distinct values it took, and how many
+// of them were suspicious
+func (p *paramSummary) write(w io.Writer) {
+	result := make([]*paramStats, 0, len(p.params))
+	for _, s := range p.params {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].count != result[j].count {
+			return result[i].count > result[j].count
+		}
+		return result[i].key < result[j].key
+	})
+
+	for _, s := range result {
+		more := ""
+		if s.overflow {
+			more = "+"
+		}
+		fmt.Fprintf(w, "%8d %s\t%d%s values", s.count, s.key, len(s.values), more)
+		if s.suspicious > 0 {
+			fmt.Fprintf(w, "\t%d suspicious", s.suspicious)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// shorten trims long values for display
+func shorten(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max] + "..."
+}
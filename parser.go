@@ -1,5 +1,7 @@
 package main
 
+import "sort"
+
 // this borrows from Ben Johnson's tutorial on parsers: https://blog.gopheracademy.com/advent-2014/parsers-lexers/
 // its license is below
 /*
@@ -25,6 +27,31 @@ IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
 CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 */
 
+// LineParser turns raw log lines into *LogLines; a nil *LogLine with a nil error means the line carried
+// no request (e.g. a directive or comment) and should be skipped
+type LineParser interface {
+	ParseLine(input string) (*LogLine, error)
+}
+
+// logFormats maps the names accepted by -log-format to constructors for their LineParsers
+var logFormats = map[string]func() LineParser{
+	"combined":    func() LineParser { return NewParser(nginxItemOrder) },
+	"haproxy":     func() LineParser { return NewHAProxyParser() },
+	"main":        func() LineParser { return NewParser(nginxMainItemOrder) },
+	"nginx-error": func() LineParser { return NewParser(nginxErrorItemOrder) },
+	"w3c":         func() LineParser { return NewW3CParser() },
+}
+
+// logFormatNames returns the sorted names of all supported log formats
+func logFormatNames() []string {
+	names := make([]string, 0, len(logFormats))
+	for name := range logFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // Parser handles collecting items and parsing them into their final values
 type Parser struct {
 	s   *Scanner
@@ -78,6 +105,7 @@ func (p *Parser) ParseLine(input string) (*LogLine, error) {
 		}
 
 		ll.add(val)
+		ll.addSpan(ip.valueType, items)
 	}
 
 	return ll, ll.Error
@@ -0,0 +1,218 @@
+package main
+
+import (
+	_ "embed" // for the public suffix list
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// publicSuffixList is a copy of https://publicsuffix.org/list/public_suffix_list.dat; replace the file to
+// update it
+//
+//go:embed public_suffix_list.dat
+var publicSuffixList string
+
+// referer classes, in the order they're checked
+const (
+	refererDirect   = "direct"
+	refererSpam     = "spam"
+	refererInternal = "internal"
+	refererSearch   = "search"
+	refererExternal = "external"
+)
+
+// ways the referers command can report each referer
+const (
+	refererByURL    = "url"
+	refererByHost   = "host"
+	refererByDomain = "domain"
+	refererByClass  = "class"
+	refererBySearch = "search"
+)
+
+var refererByModes = []string{refererByURL, refererByHost, refererByDomain, refererByClass, refererBySearch}
+
+// publicSuffixes holds the parsed list: plain rules, wildcard rules stored without their "*.", and
+// exceptions stored without their "!"
+type publicSuffixes struct {
+	rules      map[string]bool
+	wildcards  map[string]bool
+	exceptions map[string]bool
+}
+
+var (
+	suffixes     *publicSuffixes
+	suffixesOnce sync.Once
+)
+
+// loadPublicSuffixes parses the embedded list the first time it's needed
+func loadPublicSuffixes() *publicSuffixes {
+	suffixesOnce.Do(func() {
+		suffixes = &publicSuffixes{rules: map[string]bool{}, wildcards: map[string]bool{}, exceptions: map[string]bool{}}
+		for _, line := range strings.Split(publicSuffixList, "\n") {
+			// rules end at the first whitespace
+			if fields := strings.Fields(line); len(fields) > 0 {
+				line = fields[0]
+			}
+			switch {
+			case line == "" || strings.HasPrefix(line, "//"):
+			case strings.HasPrefix(line, "!"):
+				suffixes.exceptions[line[1:]] = true
+			case strings.HasPrefix(line, "*."):
+				suffixes.wildcards[line[2:]] = true
+			default:
+				suffixes.rules[line] = true
+			}
+		}
+	})
+	return suffixes
+}
+
+// registrableDomain returns the public suffix of host plus one more label, e.g. example.co.uk for
+// www.example.co.uk; IP addresses and hosts that are themselves public suffixes are returned as they are
+func registrableDomain(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" || net.ParseIP(host) != nil {
+		return host
+	}
+
+	ps := loadPublicSuffixes()
+	labels := strings.Split(host, ".")
+	n := len(labels)
+
+	// the longest matching rule wins; anything unlisted is its own top-level domain
+	suffixLen := 1
+	for i := 0; i < n; i++ {
+		candidate := strings.Join(labels[i:], ".")
+		if ps.exceptions[candidate] {
+			suffixLen = n - i - 1
+			break
+		}
+		if ps.rules[candidate] || (i+1 < n && ps.wildcards[strings.Join(labels[i+1:], ".")]) {
+			suffixLen = n - i
+			break
+		}
+	}
+
+	if suffixLen >= n {
+		return host
+	}
+	return strings.Join(labels[n-suffixLen-1:], ".")
+}
+
+// searchEngines maps the first label of a search engine's registrable domain to its name and the query
+// parameters that have carried search terms
+var searchEngines = map[string]struct {
+	name   string
+	params []string
+}{
+	"google":     {"Google", []string{"q"}},
+	"bing":       {"Bing", []string{"q"}},
+	"yahoo":      {"Yahoo", []string{"p", "q"}},
+	"duckduckgo": {"DuckDuckGo", []string{"q"}},
+	"yandex":     {"Yandex", []string{"text"}},
+	"baidu":      {"Baidu", []string{"wd", "word"}},
+	"ecosia":     {"Ecosia", []string{"q"}},
+	"qwant":      {"Qwant", []string{"q"}},
+	"startpage":  {"Startpage", []string{"query", "q"}},
+	"brave":      {"Brave Search", []string{"q"}},
+	"naver":      {"Naver", []string{"query"}},
+	"seznam":     {"Seznam", []string{"q"}},
+	"sogou":      {"Sogou", []string{"query"}},
+	"aol":        {"AOL", []string{"q"}},
+}
+
+// searchEngine returns the name of the search engine u belongs to and any search terms it carries
+func searchEngine(u *url.URL) (name string, terms string, ok bool) {
+	domain := registrableDomain(u.Hostname())
+	label := domain
+	if i := strings.IndexRune(domain, '.'); i >= 0 {
+		label = domain[:i]
+	}
+	engine, ok := searchEngines[label]
+	if !ok {
+		return "", "", false
+	}
+	// brave.com is mostly the browser's site; only its search subdomain is the engine
+	if label == "brave" && !strings.HasPrefix(strings.ToLower(u.Hostname()), "search.") {
+		return "", "", false
+	}
+	query := u.Query()
+	for _, p := range engine.params {
+		if t := query.Get(p); t != "" {
+			return engine.name, t, true
+		}
+	}
+	return engine.name, "", true
+}
+
+// domainList matches hosts against a list of domains, including their subdomains
+type domainList map[string]bool
+
+// loadDomainList reads domains, one per line with # comments, from file
+func loadDomainList(file string) (domainList, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	d := domainList{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexRune(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		d.add(line)
+	}
+	return d, nil
+}
+
+func (d domainList) add(domain string) {
+	domain = strings.TrimPrefix(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), "."), "*.")
+	if domain != "" {
+		d[domain] = true
+	}
+}
+
+func (d domainList) contains(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for host != "" {
+		if d[host] {
+			return true
+		}
+		i := strings.IndexRune(host, '.')
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return false
+}
+
+// refererClassifier sorts referers into direct, spam, internal, search and external
+type refererClassifier struct {
+	site domainList
+	spam domainList
+}
+
+func newRefererClassifier() *refererClassifier {
+	return &refererClassifier{site: domainList{}, spam: domainList{}}
+}
+
+func (r *refererClassifier) classify(ref *url.URL) string {
+	if ref == nil || ref.Hostname() == "" {
+		return refererDirect
+	}
+	host := ref.Hostname()
+	switch {
+	case r.spam.contains(host):
+		return refererSpam
+	case r.site.contains(host):
+		return refererInternal
+	}
+	if _, _, ok := searchEngine(ref); ok {
+		return refererSearch
+	}
+	return refererExternal
+}
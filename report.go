@@ -0,0 +1,502 @@
+package main
+
+import (
+	_ "embed" // for the report template
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportPage is the layout of axe report -html; everything it needs is inline, so the file can be mailed
+// around and opened anywhere
+//
+//go:embed report.html
+var reportPage string
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"count": formatCount,
+	"bytes": formatBytes,
+}).Parse(reportPage))
+
+// reportMaxBars is how many bars the charts are allowed, which picks their bucket size
+const reportMaxBars = 120
+
+// reportStats tallies the requests of the whole log, or of one path, IP or time bucket
+type reportStats struct {
+	requests     int
+	bytes        int64
+	clientErrors int
+	serverErrors int
+}
+
+func (s *reportStats) add(ll *LogLine) {
+	s.requests++
+	s.bytes += ll.BodyBytes
+	switch {
+	case ll.Status >= 500:
+		s.serverErrors++
+	case ll.Status >= 400:
+		s.clientErrors++
+	}
+}
+
+// errorRate is the share of requests that failed, as a percentage
+func (s *reportStats) errorRate() float64 {
+	if s.requests == 0 {
+		return 0
+	}
+	return float64(s.clientErrors+s.serverErrors) * 100 / float64(s.requests)
+}
+
+// report gathers everything axe report shows in one pass over the lines
+type report struct {
+	title    string
+	template bool
+	top      int
+
+	total     reportStats
+	unparsed  int
+	first     time.Time
+	last      time.Time
+	perSecond map[int64]*reportStats
+
+	statuses   *counter
+	methods    *counter
+	referers   *counter
+	userAgents *counter
+	paths      map[string]*reportStats
+	ips        map[string]*reportStats
+}
+
+func newReport() *report {
+	return &report{
+		perSecond:  map[int64]*reportStats{},
+		statuses:   newCounter(),
+		methods:    newCounter(),
+		referers:   newCounter(),
+		userAgents: newCounter(),
+		paths:      map[string]*reportStats{},
+		ips:        map[string]*reportStats{},
+	}
+}
+
+// reportAdd adds ll to the stats kept under key in m
+func reportAdd(m map[string]*reportStats, key string, ll *LogLine) {
+	s, ok := m[key]
+	if !ok {
+		s = &reportStats{}
+		m[key] = s
+	}
+	s.add(ll)
+}
+
+func (r *report) add(ll *LogLine) {
+	// error log messages aren't requests
+	if ll.ErrorLog != nil {
+		return
+	}
+	r.total.add(ll)
+
+	if !ll.Time.IsZero() {
+		if r.first.IsZero() || ll.Time.Before(r.first) {
+			r.first = ll.Time
+		}
+		if ll.Time.After(r.last) {
+			r.last = ll.Time
+		}
+		sec := ll.Time.Unix()
+		s, ok := r.perSecond[sec]
+		if !ok {
+			s = &reportStats{}
+			r.perSecond[sec] = s
+		}
+		s.add(ll)
+	}
+
+	status := "-"
+	if ll.Status != 0 {
+		status = strconv.FormatInt(ll.Status, 10)
+	}
+	r.statuses.add(status)
+	if ll.IP != nil {
+		reportAdd(r.ips, ll.IP.String(), ll)
+	}
+	if ll.Request != nil {
+		r.methods.add(ll.Request.Method)
+	}
+	path := sigmaURIStem(ll)
+	if r.template {
+		path = requestRoute(ll)
+	}
+	if path != "" {
+		reportAdd(r.paths, path, ll)
+	}
+	if ll.Referer != nil && ll.Referer.Hostname() != "" {
+		r.referers.add(registrableDomain(ll.Referer.Hostname()))
+	}
+	if ll.UserAgent != "" {
+		r.userAgents.add(ll.UserAgent)
+	}
+}
+
+// addError counts a line that couldn't be read or parsed
+func (r *report) addError(err error) {
+	r.unparsed++
+	defaultErrFunc(err)
+}
+
+// reportBucket is one bar of the charts
+type reportBucket struct {
+	start time.Time
+	reportStats
+}
+
+// buckets divides the log's time range into at most reportMaxBars buckets of one of the sizes the tui
+// sparkline uses, aligned to the log's own time zone
+func (r *report) buckets() (time.Duration, []reportBucket) {
+	if r.first.IsZero() {
+		return 0, nil
+	}
+	bucket := sparkBuckets[len(sparkBuckets)-1]
+	span := r.last.Sub(r.first) + time.Second
+	for _, b := range sparkBuckets {
+		if reportMaxBars*b >= span {
+			bucket = b
+			break
+		}
+	}
+
+	secs := int64(bucket / time.Second)
+	_, offset := r.first.Zone()
+	start := r.first.Unix() + int64(offset)
+	start = start - start%secs - int64(offset)
+	buckets := make([]reportBucket, (r.last.Unix()-start)/secs+1)
+	for i := range buckets {
+		buckets[i].start = time.Unix(start+int64(i)*secs, 0).In(r.first.Location())
+	}
+	for sec, s := range r.perSecond {
+		b := &buckets[(sec-start)/secs]
+		b.requests += s.requests
+		b.bytes += s.bytes
+		b.clientErrors += s.clientErrors
+		b.serverErrors += s.serverErrors
+	}
+	return bucket, buckets
+}
+
+// reportCard is one of the headline numbers at the top of the report
+type reportCard struct {
+	Label, Value, Note string
+}
+
+// reportRow is a row of a top list: a value, how often it was seen, and a bar scaled to the top row
+type reportRow struct {
+	Key   string
+	Count int
+	Share string
+	Bar   string
+}
+
+// reportStatsRow is a row of a table of paths, IPs or time buckets
+type reportStatsRow struct {
+	Key          string
+	Requests     int
+	Bytes        int64
+	ClientErrors int
+	ServerErrors int
+	ErrorRate    string
+	Bar          string
+}
+
+// reportData is what the template is given
+type reportData struct {
+	Title     string
+	Range     string
+	Generated string
+	Cards     []reportCard
+
+	Bucket    string
+	Traffic   template.HTML
+	Bandwidth template.HTML
+
+	Classes    []reportRow
+	Statuses   []reportRow
+	Methods    []reportRow
+	Paths      []reportStatsRow
+	IPs        []reportStatsRow
+	Referers   []reportRow
+	UserAgents []reportRow
+	Heaviest   []reportStatsRow
+
+	ServerErrorPaths []reportStatsRow
+	ClientErrorPaths []reportStatsRow
+	ErrorTimes       []reportStatsRow
+}
+
+// write renders the report as a single HTML page
+func (r *report) write(w io.Writer) error {
+	data := reportData{
+		Title:     r.title,
+		Range:     "no timestamps",
+		Generated: time.Now().Format("2006-01-02 15:04:05 -0700"),
+	}
+	if !r.first.IsZero() {
+		data.Range = fmt.Sprintf("%s to %s", r.first.Format("2006-01-02 15:04:05 -0700"), r.last.Format("2006-01-02 15:04:05 -0700"))
+	}
+
+	t := &r.total
+	data.Cards = []reportCard{
+		{"Requests", formatCount(t.requests), ""},
+		{"Unique IPs", formatCount(len(r.ips)), ""},
+		{"Bandwidth", formatBytes(t.bytes), ""},
+		{"Average response", formatBytes(int64(math.Round(float64(t.bytes) / math.Max(1, float64(t.requests))))), ""},
+		{"Client errors", formatShare(t.clientErrors, t.requests), formatCount(t.clientErrors) + " 4xx"},
+		{"Server errors", formatShare(t.serverErrors, t.requests), formatCount(t.serverErrors) + " 5xx"},
+	}
+	if r.unparsed > 0 {
+		data.Cards = append(data.Cards, reportCard{"Unparsed lines", formatCount(r.unparsed), ""})
+	}
+
+	bucket, buckets := r.buckets()
+	if len(buckets) > 0 {
+		data.Bucket = shortDuration(bucket)
+		data.Traffic, data.Bandwidth = reportCharts(bucket, buckets)
+	}
+
+	classes := newCounter()
+	for status, n := range r.statuses.counts {
+		class := "other"
+		if len(status) == 3 && status[0] >= '1' && status[0] <= '5' {
+			class = status[:1] + "xx"
+		}
+		classes.counts[class] += n
+		classes.total += n
+	}
+	data.Classes = reportRows(classes, 0)
+	sort.Slice(data.Classes, func(i, j int) bool { return data.Classes[i].Key < data.Classes[j].Key })
+	data.Statuses = reportRows(r.statuses, r.top)
+	data.Methods = reportRows(r.methods, r.top)
+	data.Referers = reportRows(r.referers, r.top)
+	data.UserAgents = reportRows(r.userAgents, r.top)
+
+	requests := func(s *reportStats) int64 { return int64(s.requests) }
+	data.Paths = reportStatsRows(r.paths, r.top, requests)
+	data.IPs = reportStatsRows(r.ips, r.top, requests)
+	data.Heaviest = reportStatsRows(r.paths, r.top, func(s *reportStats) int64 { return s.bytes })
+	data.ServerErrorPaths = reportStatsRows(r.paths, r.top, func(s *reportStats) int64 { return int64(s.serverErrors) })
+	data.ClientErrorPaths = reportStatsRows(r.paths, r.top, func(s *reportStats) int64 { return int64(s.clientErrors) })
+
+	// the worst stretches of time, in the buckets the charts use
+	times := map[string]*reportStats{}
+	for i := range buckets {
+		b := &buckets[i]
+		times[reportTime(b.start, bucket)] = &b.reportStats
+	}
+	data.ErrorTimes = reportStatsRows(times, 10, func(s *reportStats) int64 { return int64(s.clientErrors + s.serverErrors) })
+
+	return reportTemplate.Execute(w, data)
+}
+
+// reportRows returns the top n keys of c, or all of them if n is 0
+func reportRows(c *counter, n int) []reportRow {
+	sorted := c.sorted()
+	if n > 0 && len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	rows := make([]reportRow, len(sorted))
+	for i, ct := range sorted {
+		rows[i] = reportRow{
+			Key:   ct.key,
+			Count: ct.n,
+			Share: formatShare(ct.n, c.total),
+			Bar:   reportBar(float64(ct.n), float64(sorted[0].n)),
+		}
+	}
+	return rows
+}
+
+// reportStatsRows returns the n entries of m with the highest value, leaving out those where it's 0
+func reportStatsRows(m map[string]*reportStats, n int, value func(s *reportStats) int64) []reportStatsRow {
+	keys := make([]string, 0, len(m))
+	for k, s := range m {
+		if value(s) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := value(m[keys[i]]), value(m[keys[j]])
+		if a != b {
+			return a > b
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+
+	rows := make([]reportStatsRow, len(keys))
+	for i, k := range keys {
+		s := m[k]
+		rows[i] = reportStatsRow{
+			Key:          k,
+			Requests:     s.requests,
+			Bytes:        s.bytes,
+			ClientErrors: s.clientErrors,
+			ServerErrors: s.serverErrors,
+			ErrorRate:    strconv.FormatFloat(s.errorRate(), 'f', 1, 64) + "%",
+			Bar:          reportBar(float64(value(s)), float64(value(m[keys[0]]))),
+		}
+	}
+	return rows
+}
+
+func reportRatio(n, max int) float64 {
+	if max == 0 {
+		return 0
+	}
+	return float64(n) / float64(max)
+}
+
+// reportBar is the width of a table bar, as a CSS percentage
+func reportBar(n, max float64) string {
+	if max == 0 {
+		return "0%"
+	}
+	return strconv.FormatFloat(n*100/max, 'f', 1, 64) + "%"
+}
+
+// reportTime labels a bucket of the given size
+func reportTime(t time.Time, bucket time.Duration) string {
+	if bucket >= 24*time.Hour {
+		return t.Format("2006-01-02")
+	}
+	if bucket >= time.Minute {
+		return t.Format("2006-01-02 15:04")
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// reportCharts draws the traffic chart, stacking errors on the rest, and the bandwidth chart
+func reportCharts(bucket time.Duration, buckets []reportBucket) (traffic template.HTML, bandwidth template.HTML) {
+	trafficBars := make([]chartBar, len(buckets))
+	bandwidthBars := make([]chartBar, len(buckets))
+	for i, b := range buckets {
+		label := reportTime(b.start, bucket)
+		ok := b.requests - b.clientErrors - b.serverErrors
+		trafficBars[i] = chartBar{
+			label:  label,
+			values: []float64{float64(ok), float64(b.clientErrors), float64(b.serverErrors)},
+			title: fmt.Sprintf("%s: %s requests, %s 4xx, %s 5xx", label,
+				formatCount(b.requests), formatCount(b.clientErrors), formatCount(b.serverErrors)),
+		}
+		bandwidthBars[i] = chartBar{
+			label:  label,
+			values: []float64{float64(b.bytes)},
+			title:  fmt.Sprintf("%s: %s", label, formatBytes(b.bytes)),
+		}
+	}
+	traffic = barChart(trafficBars, []string{"ok", "client", "server"}, func(v float64) string { return formatCount(int(v)) })
+	bandwidth = barChart(bandwidthBars, []string{"bytes"}, func(v float64) string { return formatBytes(int64(v)) })
+	return traffic, bandwidth
+}
+
+// chartBar is one bar of a barChart: its values are stacked from the bottom, and its title is shown on hover
+type chartBar struct {
+	label  string
+	values []float64
+	title  string
+}
+
+// barChart draws bars as an SVG, coloring each of the stacked values with the CSS classes given
+func barChart(bars []chartBar, classes []string, format func(float64) string) template.HTML {
+	const width, height = 960.0, 220.0
+	const left, bottom, top = 70.0, 24.0, 8.0
+	plotWidth, plotHeight := width-left, height-bottom-top
+
+	var max float64
+	for _, b := range bars {
+		var sum float64
+		for _, v := range b.values {
+			sum += v
+		}
+		max = math.Max(max, sum)
+	}
+	if max == 0 {
+		max = 1
+	}
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg class="chart" viewBox="0 0 %g %g" role="img">`, width, height)
+	for _, frac := range []float64{0, 0.5, 1} {
+		y := top + plotHeight*(1-frac)
+		fmt.Fprintf(&svg, `<line class="grid" x1="%g" y1="%.1f" x2="%g" y2="%.1f"/>`, left, y, width, y)
+		fmt.Fprintf(&svg, `<text class="axis" x="%g" y="%.1f" text-anchor="end">%s</text>`, left-6, y+4, html.EscapeString(format(max*frac)))
+	}
+
+	barWidth := plotWidth / float64(len(bars))
+	gap := math.Min(1, barWidth/4)
+	for i, b := range bars {
+		x := left + float64(i)*barWidth
+		fmt.Fprintf(&svg, `<g><title>%s</title>`, html.EscapeString(b.title))
+		// an invisible full-height bar, so that the title shows anywhere above a short bar
+		fmt.Fprintf(&svg, `<rect class="hover" x="%.2f" y="%g" width="%.2f" height="%g"/>`, x, top, barWidth, plotHeight)
+		y := top + plotHeight
+		for j, v := range b.values {
+			h := plotHeight * v / max
+			y -= h
+			if h > 0 {
+				fmt.Fprintf(&svg, `<rect class="%s" x="%.2f" y="%.2f" width="%.2f" height="%.2f"/>`, classes[j], x, y, barWidth-gap, h)
+			}
+		}
+		svg.WriteString(`</g>`)
+	}
+
+	// label the first bar and a few more evenly spaced, as room allows
+	labels := 5
+	if len(bars) < labels {
+		labels = len(bars)
+	}
+	step := int(math.Ceil(float64(len(bars)) / float64(labels)))
+	for i := 0; i < len(bars); i += step {
+		fmt.Fprintf(&svg, `<text class="axis" x="%.2f" y="%g">%s</text>`, left+float64(i)*barWidth, height-6, html.EscapeString(bars[i].label))
+	}
+	svg.WriteString(`</svg>`)
+	return template.HTML(svg.String())
+}
+
+// formatCount formats n with thousands separators
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	if n < 0 {
+		return "-" + formatCount(-n)
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// formatBytes formats n in the largest binary unit it has at least one of
+func formatBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	v, i := float64(n)/1024, 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64) + " " + units[i:i+1] + "iB"
+}
+
+// formatShare formats n as a percentage of total
+func formatShare(n, total int) string {
+	return strconv.FormatFloat(reportRatio(n, total)*100, 'f', 1, 64) + "%"
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// what to do with query strings when templating paths
+const (
+	queryKeep  = "keep"
+	queryStrip = "strip"
+	queryKeys  = "keys"
+)
+
+var queryModes = []string{queryKeep, queryStrip, queryKeys}
+
+var (
+	uuidSegment  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	dateSegment  = regexp.MustCompile(`^(19|20)\d\d-?(0[1-9]|1[0-2])-?(0[1-9]|[12]\d|3[01])$`)
+	idSegment    = regexp.MustCompile(`^\d+$`)
+	hashSegment  = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	tokenSegment = regexp.MustCompile(`^[A-Za-z0-9_]{20,}$`)
+	digit        = regexp.MustCompile(`\d`)
+)
+
+// templateSegment replaces a path segment that's obviously an identifier with a placeholder; dates are
+// checked before they can be taken for numeric IDs, and tokens must mix letters and digits so that long
+// words aren't mistaken for them
+func templateSegment(s string) string {
+	switch {
+	case uuidSegment.MatchString(s):
+		return "{uuid}"
+	case dateSegment.MatchString(s):
+		return "{date}"
+	case idSegment.MatchString(s):
+		return "{id}"
+	case hashSegment.MatchString(s):
+		return "{hash}"
+	case tokenSegment.MatchString(s) && digit.MatchString(s) && strings.ToLower(s) != strings.ToUpper(s):
+		return "{token}"
+	}
+	return s
+}
+
+// route is a path pattern like /users/{id}/posts, where a {name} segment matches any one segment
+type route struct {
+	pattern  string
+	segments []string
+	literals int
+}
+
+func newRoute(pattern string) *route {
+	r := &route{pattern: pattern, segments: strings.Split(strings.Trim(pattern, "/"), "/")}
+	for _, s := range r.segments {
+		if !isRouteParam(s) {
+			r.literals++
+		}
+	}
+	return r
+}
+
+func isRouteParam(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+func (r *route) matches(segments []string) bool {
+	if len(segments) != len(r.segments) {
+		return false
+	}
+	for i, s := range r.segments {
+		if !isRouteParam(s) && s != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pathTemplater collapses request paths into routes, so that /users/123 and /users/456 count together
+type pathTemplater struct {
+	routes []*route
+	auto   bool
+	query  string
+}
+
+func newPathTemplater() *pathTemplater {
+	return &pathTemplater{query: queryKeep}
+}
+
+// active reports whether template would change anything
+func (p *pathTemplater) active() bool {
+	return len(p.routes) > 0 || p.auto || p.query != queryKeep
+}
+
+// addRoutes adds routes from file, which is either an OpenAPI / Swagger spec (JSON or YAML) or a list of
+// paths, one per line with # comments
+func (p *pathTemplater) addRoutes(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var patterns []string
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json", ".yaml", ".yml":
+		patterns, err = openAPIPaths(file, data)
+		if err != nil {
+			return err
+		}
+	default:
+		s := bufio.NewScanner(strings.NewReader(string(data)))
+		for s.Scan() {
+			line := s.Text()
+			if i := strings.IndexRune(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			// allow "GET /users/{id}" as well as "/users/{id}"
+			if fields := strings.Fields(line); len(fields) > 0 {
+				patterns = append(patterns, fields[len(fields)-1])
+			}
+		}
+	}
+
+	for _, pattern := range patterns {
+		p.routes = append(p.routes, newRoute(pattern))
+	}
+	// prefer /users/me over /users/{id}
+	sort.SliceStable(p.routes, func(i, j int) bool { return p.routes[i].literals > p.routes[j].literals })
+	return nil
+}
+
+// openAPIPaths returns the paths an OpenAPI 3 or Swagger 2 spec defines, including any base path
+func openAPIPaths(file string, data []byte) ([]string, error) {
+	var spec map[string]interface{}
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		if err := json.Unmarshal(data, &spec); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	} else {
+		docs, err := parseYAMLDocuments(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if len(docs) > 0 {
+			spec, _ = docs[0].(map[string]interface{})
+		}
+	}
+
+	paths, ok := spec["paths"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: no paths defined", file)
+	}
+
+	base, _ := spec["basePath"].(string)
+	if servers, ok := spec["servers"].([]interface{}); ok && len(servers) > 0 {
+		if server, ok := servers[0].(map[string]interface{}); ok {
+			if u, ok := server["url"].(string); ok {
+				if parsed, err := url.Parse(u); err == nil {
+					base = parsed.Path
+				}
+			}
+		}
+	}
+	base = strings.TrimSuffix(base, "/")
+
+	result := make([]string, 0, len(paths))
+	for path := range paths {
+		result = append(result, base+path)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// template returns u's path as a route, with its query string kept, stripped or reduced to its keys
+func (p *pathTemplater) template(u *url.URL) string {
+	path := p.templatePath(u.EscapedPath())
+
+	switch {
+	case p.query == queryStrip || u.RawQuery == "":
+		return path
+	case p.query == queryKeys:
+		keys := []string{}
+		for k := range u.Query() {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return path + "?" + strings.Join(keys, "&")
+	}
+	return path + "?" + u.RawQuery
+}
+
+func (p *pathTemplater) templatePath(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, r := range p.routes {
+		if r.matches(segments) {
+			return r.pattern
+		}
+	}
+	if !p.auto {
+		return path
+	}
+
+	for i, s := range segments {
+		segments[i] = templateSegment(s)
+	}
+	result := "/" + strings.Join(segments, "/")
+	if strings.HasSuffix(path, "/") && result != "/" {
+		result += "/"
+	}
+	return result
+}
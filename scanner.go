@@ -215,6 +215,29 @@ func scanWord(s *Scanner) stateFn {
 	return nil
 }
 
+// scanField consumes everything up to the next space, including delimiters
+func scanField(s *Scanner) stateFn {
+	s.acceptUntilRuneFn(isSpace)
+	s.emit(itemField)
+	return nil
+}
+
+// scanBlock consumes the contents of a {}-delimited block, e.g. HAProxy's {captured|headers}, which may be
+// empty and may contain other delimiters
+func scanBlock(s *Scanner) stateFn {
+	s.acceptUntil('}')
+	s.emit(itemField)
+	return nil
+}
+
+// scanRest consumes everything up to the end of the line
+func scanRest(s *Scanner) stateFn {
+	for s.next() != eof {
+	}
+	s.emit(itemField)
+	return nil
+}
+
 func scanInt(s *Scanner) stateFn {
 	s.acceptRun(digits)
 	s.emit(itemInt)
@@ -335,11 +358,14 @@ func isNewline(r rune) bool {
 }
 */
 
+var blockProducer = itemProducer{scanBlock, itemField}
+var fieldProducer = itemProducer{scanField, itemField}
 var intProducer = itemProducer{scanInt, itemInt}
 var ipProducer = itemProducer{scanIP, itemIP}
 var leftDelimProducer = itemProducer{scanLeftDelimiter, itemLeftDelimiter}
 var rightDelimProducer = itemProducer{scanRightDelimiter, itemRightDelimiter}
 var quotedStringProducer = itemProducer{scanQuotedString, itemQuotedString}
+var restProducer = itemProducer{scanRest, itemField}
 var wordProducer = itemProducer{scanWord, itemWord}
 
 // UNUSED
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultTopRows is how many values /top returns if not asked for a number
+const defaultTopRows = 10
+
+// server answers queries over HTTP, reading the log files afresh for each one with the same parsers,
+// filters, indexes and merging as the command line. Results stream as JSON lines; lines that can't be
+// parsed are left out, as sql leaves them out of its results.
+type server struct {
+	paths      []string
+	newParser  func() LineParser
+	seekParser func() LineParser
+	maxRows    int
+}
+
+// files returns the log files in s.paths as they are now, so that rotated logs are picked up. Directories
+// give the files directly inside them, except indexes and hidden files.
+func (s *server) files() ([]string, error) {
+	var files []string
+	for _, path := range s.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if strings.HasPrefix(name, ".") || strings.HasSuffix(name, indexSuffix) || strings.HasSuffix(name, indexSuffix+".tmp") {
+				continue
+			}
+			// symlinks are followed
+			file := filepath.Join(path, name)
+			if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+				files = append(files, file)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// listenAndServe serves the API on addr until it fails
+func (s *server) listenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveIndex)
+	mux.HandleFunc("/query", s.handle(s.buildQuery))
+	mux.HandleFunc("/top", s.handle(buildTop))
+	mux.HandleFunc("/timeseries", s.handle(buildTimeseries))
+
+	fmt.Fprintf(os.Stderr, "serving on http://%s/\n", ln.Addr())
+	return http.Serve(ln, mux)
+}
+
+// serveIndex describes the API: the files it reads, their columns, and the endpoints
+func (s *server) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		serveError(w, http.StatusNotFound, fmt.Errorf("not found: %s", r.URL.Path))
+		return
+	}
+	files, err := s.files()
+	if err != nil {
+		serveError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"files":   files,
+		"columns": sqlColumnNames,
+		"filters": append(lineSelectionOptions, "where"),
+		"endpoints": map[string]string{
+			"/query":      "lines, as objects of the columns given by fields (default all), up to limit",
+			"/top":        "the most common values of field, with their counts, up to n",
+			"/timeseries": "requests and bytes per bucket of time (default 1m)",
+		},
+	})
+}
+
+// handle runs the query build makes from a request's parameters over the lines its filters select,
+// streaming the results
+func (s *server) handle(build func(params url.Values) (*sqlQuery, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		sel, err := parseLineSelection(params.Get, "", time.Now())
+		if err != nil {
+			serveError(w, http.StatusBadRequest, err)
+			return
+		}
+		var where *sqlNode
+		if src := params.Get("where"); src != "" {
+			if where, err = parseSQLWhere(src); err != nil {
+				serveError(w, http.StatusBadRequest, fmt.Errorf("where: %v", err))
+				return
+			}
+		}
+		q, err := build(params)
+		if err != nil {
+			serveError(w, http.StatusBadRequest, err)
+			return
+		}
+		files, err := s.files()
+		if err != nil {
+			serveError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		// reading stops when the client goes away, or once the query has all the rows it wants
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		var sources []*mergeSource
+		for _, file := range files {
+			src, err := openMergeSource(file, s.seekParser, sel.indexQuery())
+			if err != nil {
+				for _, src := range sources {
+					src.file.Close()
+				}
+				serveError(w, http.StatusInternalServerError, err)
+				return
+			}
+			src.reader = &contextReader{ctx: ctx, r: src.reader}
+			sources = append(sources, src)
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		q.out = newSQLWriter(flushWriter{w}, sqlFormatJSON, false)
+		if len(sources) > 0 {
+			pf := sel.wrap(func(ll *LogLine) {
+				if q.full() || (where != nil && !sqlTruthy(where.eval(&sqlContext{ll: ll}))) {
+					return
+				}
+				q.add(ll)
+				if q.full() {
+					cancel()
+				}
+			})
+			axe := NewAxe(1, nil, s.newParser, pf, func(error) {})
+			axe.setLongLines(*maxLineLength, *longLines)
+			axe.merge(sources, *mergeTolerance)
+			if err := axe.Start(); err != nil && ctx.Err() == nil {
+				defaultErrFunc(fmt.Errorf("serve: %s: %v", r.URL, err))
+			}
+		}
+		if r.Context().Err() == nil {
+			q.finish()
+		}
+	}
+}
+
+// buildQuery makes the query for /query?fields=ip,path&limit=100
+func (s *server) buildQuery(params url.Values) (*sqlQuery, error) {
+	fields := "*"
+	if f := params.Get("fields"); f != "" {
+		names := strings.Split(f, ",")
+		for i, name := range names {
+			names[i] = strings.TrimSpace(name)
+			if err := checkColumn(names[i]); err != nil {
+				return nil, err
+			}
+		}
+		fields = strings.Join(names, ", ")
+	}
+
+	limit := s.maxRows
+	if l := params.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid limit: %s", l)
+		}
+		if s.maxRows == 0 || n < s.maxRows {
+			limit = n
+		}
+	}
+	src := "SELECT " + fields
+	if limit > 0 {
+		src += " LIMIT " + strconv.Itoa(limit)
+	}
+	return parseSQL(src)
+}
+
+// buildTop makes the query for /top?field=ip&n=10
+func buildTop(params url.Values) (*sqlQuery, error) {
+	field := params.Get("field")
+	if field == "" {
+		return nil, fmt.Errorf("field is required; columns are %s", strings.Join(sqlColumnNames, ", "))
+	}
+	if err := checkColumn(field); err != nil {
+		return nil, err
+	}
+	n := defaultTopRows
+	if v := params.Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid n: %s", v)
+		}
+	}
+	return parseSQL(fmt.Sprintf("SELECT %s, count(*) AS count WHERE %s IS NOT NULL GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT %d", field, field, n))
+}
+
+// buildTimeseries makes the query for /timeseries?bucket=1m
+func buildTimeseries(params url.Values) (*sqlQuery, error) {
+	bucket := time.Minute
+	if v := params.Get("bucket"); v != "" {
+		var err error
+		if bucket, err = time.ParseDuration(v); err != nil || bucket <= 0 {
+			return nil, fmt.Errorf("invalid bucket: %s", v)
+		}
+	}
+	return parseSQL(fmt.Sprintf("SELECT time_bucket('%s', time) AS time, count(*) AS requests, sum(bytes) AS bytes WHERE time IS NOT NULL GROUP BY 1 ORDER BY 1", bucket))
+}
+
+// checkColumn checks a column name given as a parameter, before it goes into a query
+func checkColumn(name string) error {
+	if _, ok := sqlColumns[name]; !ok {
+		return fmt.Errorf("unknown column: %s; columns are %s", name, strings.Join(sqlColumnNames, ", "))
+	}
+	return nil
+}
+
+func serveError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// flushWriter sends each write to the client straight away, so that rows arrive as they're found
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
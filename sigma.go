@@ -0,0 +1,601 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// sigmaLevels lists Sigma rule levels, least severe first
+var sigmaLevels = []string{"informational", "low", "medium", "high", "critical"}
+
+func sigmaLevelRank(level string) int {
+	for i, l := range sigmaLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// sigmaFields maps the field names used by Sigma's webserver log source (and their common W3C spellings)
+// to the matching LogLine values
+var sigmaFields = map[string]func(*LogLine) string{
+	"c-ip":   func(l *LogLine) string { return ipString(l.IP) },
+	"src_ip": func(l *LogLine) string { return ipString(l.IP) },
+	"cs-method": func(l *LogLine) string {
+		if l.Request == nil {
+			return ""
+		}
+		return l.Request.Method
+	},
+	"c-uri":        sigmaURI,
+	"cs-uri":       sigmaURI,
+	"cs-uri-stem":  sigmaURIStem,
+	"c-uri-stem":   sigmaURIStem,
+	"cs-uri-query": sigmaURIQuery,
+	"c-uri-query":  sigmaURIQuery,
+	"cs-version": func(l *LogLine) string {
+		if l.Request == nil {
+			return ""
+		}
+		return l.Request.Proto
+	},
+	"cs-host": func(l *LogLine) string {
+		if l.Request == nil {
+			return ""
+		}
+		return l.Request.Host
+	},
+	"sc-status":   func(l *LogLine) string { return strconv.FormatInt(l.Status, 10) },
+	"sc-bytes":    func(l *LogLine) string { return strconv.FormatInt(l.BodyBytes, 10) },
+	"cs-username": func(l *LogLine) string { return l.User },
+	"cs-referer": func(l *LogLine) string {
+		if l.Referer == nil {
+			return ""
+		}
+		return l.Referer.String()
+	},
+	"c-useragent": func(l *LogLine) string { return l.UserAgent },
+	"time-taken":  func(l *LogLine) string { return strconv.FormatInt(int64(l.RequestTime/1e6), 10) },
+}
+
+// sigmaFieldAliases are alternative spellings of sigmaFields keys
+var sigmaFieldAliases = map[string]string{
+	"cs(referer)":    "cs-referer",
+	"cs-referrer":    "cs-referer",
+	"cs(user-agent)": "c-useragent",
+	"cs-user-agent":  "c-useragent",
+	"cs(host)":       "cs-host",
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func sigmaURI(l *LogLine) string {
+	if l.Request == nil || l.Request.URL == nil {
+		return ""
+	}
+	return l.Request.URL.RequestURI()
+}
+
+func sigmaURIStem(l *LogLine) string {
+	if l.Request == nil || l.Request.URL == nil {
+		return ""
+	}
+	return l.Request.URL.EscapedPath()
+}
+
+func sigmaURIQuery(l *LogLine) string {
+	if l.Request == nil || l.Request.URL == nil {
+		return ""
+	}
+	return l.Request.URL.RawQuery
+}
+
+// sigmaRule is a loaded detection rule
+type sigmaRule struct {
+	Title string
+	ID    string
+	Level string
+	File  string
+
+	selections map[string]sigmaSelection
+	condition  sigmaCondition
+}
+
+// matches evaluates the rule's condition against ll
+func (r *sigmaRule) matches(ll *LogLine) bool {
+	return r.condition(func(name string) bool {
+		return r.selections[name](ll)
+	})
+}
+
+// sigmaSelection decides whether a line matches one named selection
+type sigmaSelection func(*LogLine) bool
+
+// sigmaCondition evaluates a condition, given a way to evaluate the selections it names
+type sigmaCondition func(selected func(string) bool) bool
+
+// loadSigmaRules loads every rule from the files matching each of patterns
+func loadSigmaRules(patterns []string) ([]*sigmaRule, error) {
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no rule files match %s", pattern)
+		}
+		files = append(files, matches...)
+	}
+
+	var rules []*sigmaRule
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		docs, err := parseYAMLDocuments(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		for _, doc := range docs {
+			m, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: rule must be a mapping", file)
+			}
+			rule, err := newSigmaRule(m)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			if rule == nil {
+				continue
+			}
+			rule.File = file
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, nil
+}
+
+// newSigmaRule builds a rule from a parsed YAML document; it returns nil for rules whose log source isn't
+// a web server, so that mixed rule directories can be pointed at directly
+func newSigmaRule(doc map[string]interface{}) (*sigmaRule, error) {
+	if ls, ok := doc["logsource"].(map[string]interface{}); ok {
+		if category, ok := ls["category"].(string); ok && category != "webserver" {
+			return nil, nil
+		}
+	}
+
+	rule := &sigmaRule{selections: map[string]sigmaSelection{}}
+	rule.Title, _ = doc["title"].(string)
+	rule.ID, _ = doc["id"].(string)
+	rule.Level, _ = doc["level"].(string)
+	if rule.Title == "" {
+		return nil, fmt.Errorf("rule has no title")
+	}
+	if rule.Level == "" {
+		rule.Level = "medium"
+	}
+	if sigmaLevelRank(rule.Level) < 0 {
+		return nil, fmt.Errorf("%s: unknown level: %s", rule.Title, rule.Level)
+	}
+
+	detection, ok := doc["detection"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: rule has no detection", rule.Title)
+	}
+
+	var condition string
+	for name, def := range detection {
+		if name == "condition" {
+			switch c := def.(type) {
+			case string:
+				condition = c
+			case []interface{}:
+				// multiple conditions are alternatives
+				parts := make([]string, 0, len(c))
+				for _, part := range c {
+					parts = append(parts, fmt.Sprintf("(%v)", part))
+				}
+				condition = strings.Join(parts, " or ")
+			}
+			continue
+		}
+		if name == "timeframe" {
+			continue
+		}
+		sel, err := newSigmaSelection(def)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", rule.Title, name, err)
+		}
+		rule.selections[name] = sel
+	}
+	if condition == "" {
+		return nil, fmt.Errorf("%s: detection has no condition", rule.Title)
+	}
+
+	names := make([]string, 0, len(rule.selections))
+	for name := range rule.selections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cond, err := parseSigmaCondition(condition, names)
+	if err != nil {
+		return nil, fmt.Errorf("%s: condition: %v", rule.Title, err)
+	}
+	rule.condition = cond
+
+	return rule, nil
+}
+
+// newSigmaSelection compiles a selection: a mapping of field matchers that must all match, a list of such
+// mappings of which any must match, or a list of keywords searched for in the whole line
+func newSigmaSelection(def interface{}) (sigmaSelection, error) {
+	switch d := def.(type) {
+	case map[string]interface{}:
+		var matchers []sigmaSelection
+		for field, val := range d {
+			m, err := newSigmaFieldMatcher(field, val)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, m)
+		}
+		return func(ll *LogLine) bool {
+			for _, m := range matchers {
+				if !m(ll) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	case []interface{}:
+		var alternatives []sigmaSelection
+		var keywords []*regexp.Regexp
+		for _, item := range d {
+			switch i := item.(type) {
+			case map[string]interface{}:
+				sel, err := newSigmaSelection(i)
+				if err != nil {
+					return nil, err
+				}
+				alternatives = append(alternatives, sel)
+			case string:
+				keywords = append(keywords, sigmaWildcard("*"+i+"*"))
+			default:
+				return nil, fmt.Errorf("unsupported list item: %v", item)
+			}
+		}
+		return func(ll *LogLine) bool {
+			for _, alt := range alternatives {
+				if alt(ll) {
+					return true
+				}
+			}
+			for _, kw := range keywords {
+				if kw.MatchString(ll.Raw) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case string:
+		kw := sigmaWildcard("*" + d + "*")
+		return func(ll *LogLine) bool { return kw.MatchString(ll.Raw) }, nil
+	}
+	return nil, fmt.Errorf("unsupported selection: %v", def)
+}
+
+// newSigmaFieldMatcher compiles "field|modifier|...: value(s)"
+func newSigmaFieldMatcher(spec string, val interface{}) (sigmaSelection, error) {
+	parts := strings.Split(spec, "|")
+	field := strings.ToLower(parts[0])
+	if alias, ok := sigmaFieldAliases[field]; ok {
+		field = alias
+	}
+	get, ok := sigmaFields[field]
+	if !ok {
+		return nil, fmt.Errorf("unsupported field: %s", parts[0])
+	}
+
+	var values []interface{}
+	switch v := val.(type) {
+	case []interface{}:
+		values = v
+	default:
+		values = []interface{}{v}
+	}
+
+	all := false
+	kind := ""
+	for _, mod := range parts[1:] {
+		switch mod {
+		case "all":
+			all = true
+		case "contains", "startswith", "endswith", "re", "cidr", "lt", "lte", "gt", "gte":
+			kind = mod
+		default:
+			return nil, fmt.Errorf("unsupported modifier: %s", mod)
+		}
+	}
+
+	var tests []func(string) bool
+	for _, v := range values {
+		test, err := sigmaValueTest(kind, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", spec, err)
+		}
+		tests = append(tests, test)
+	}
+
+	return func(ll *LogLine) bool {
+		s := get(ll)
+		for _, test := range tests {
+			matched := test(s)
+			if matched && !all {
+				return true
+			} else if !matched && all {
+				return false
+			}
+		}
+		return all
+	}, nil
+}
+
+// sigmaValueTest compiles a single value with the given modifier
+func sigmaValueTest(kind string, v interface{}) (func(string) bool, error) {
+	if v == nil {
+		return func(s string) bool { return s == "" || s == "-" }, nil
+	}
+	str, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("unsupported value: %v", v)
+	}
+
+	switch kind {
+	case "re":
+		re, err := regexp.Compile(str)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	case "cidr":
+		_, ipNet, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, err
+		}
+		return func(s string) bool {
+			ip := net.ParseIP(s)
+			return ip != nil && ipNet.Contains(ip)
+		}, nil
+	case "lt", "lte", "gt", "gte":
+		n, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return nil, err
+		}
+		return func(s string) bool {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return false
+			}
+			switch kind {
+			case "lt":
+				return f < n
+			case "lte":
+				return f <= n
+			case "gt":
+				return f > n
+			}
+			return f >= n
+		}, nil
+	case "contains":
+		str = "*" + str + "*"
+	case "startswith":
+		str = str + "*"
+	case "endswith":
+		str = "*" + str
+	}
+	return sigmaWildcard(str).MatchString, nil
+}
+
+// sigmaWildcard compiles a Sigma string value, where * and ? are wildcards unless escaped with \ and
+// matching is case-insensitive
+func sigmaWildcard(s string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?is)^")
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(`*?\`, s[i+1]) >= 0:
+			b.WriteString(regexp.QuoteMeta(s[i+1 : i+2]))
+			i++
+		case c == '*':
+			b.WriteString(".*")
+		case c == '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(s[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// parseSigmaCondition parses conditions like "selection and not (filter1 or filter2)",
+// "1 of selection*", and "all of them"
+func parseSigmaCondition(cond string, names []string) (sigmaCondition, error) {
+	p := &sigmaConditionParser{tokens: tokenizeSigmaCondition(cond), names: names}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return c, nil
+}
+
+func tokenizeSigmaCondition(cond string) []string {
+	var tokens []string
+	cur := ""
+	for _, r := range cond {
+		switch {
+		case r == '(' || r == ')' || r == '|':
+			if cur != "" {
+				tokens = append(tokens, cur)
+				cur = ""
+			}
+			tokens = append(tokens, string(r))
+		case unicode.IsSpace(r):
+			if cur != "" {
+				tokens = append(tokens, cur)
+				cur = ""
+			}
+		default:
+			cur += string(r)
+		}
+	}
+	if cur != "" {
+		tokens = append(tokens, cur)
+	}
+	return tokens
+}
+
+type sigmaConditionParser struct {
+	tokens []string
+	pos    int
+	names  []string
+}
+
+func (p *sigmaConditionParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return strings.ToLower(p.tokens[p.pos])
+}
+
+func (p *sigmaConditionParser) parseOr() (sigmaCondition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(sel func(string) bool) bool { return l(sel) || right(sel) }
+	}
+	return left, nil
+}
+
+func (p *sigmaConditionParser) parseAnd() (sigmaCondition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(sel func(string) bool) bool { return l(sel) && right(sel) }
+	}
+	return left, nil
+}
+
+func (p *sigmaConditionParser) parseNot() (sigmaCondition, error) {
+	if p.peek() == "not" {
+		p.pos++
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(sel func(string) bool) bool { return !c(sel) }, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *sigmaConditionParser) parseTerm() (sigmaCondition, error) {
+	tok := p.peek()
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end of condition")
+	case tok == "(":
+		p.pos++
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return c, nil
+	case tok == "|":
+		return nil, fmt.Errorf("aggregations (| count() ...) aren't supported")
+	case tok == "1" || tok == "any" || tok == "all":
+		if p.pos+2 < len(p.tokens) && strings.ToLower(p.tokens[p.pos+1]) == "of" {
+			pattern := p.tokens[p.pos+2]
+			p.pos += 3
+			return p.quantifier(tok == "all", pattern)
+		}
+	}
+
+	name := p.tokens[p.pos]
+	if !p.hasName(name) {
+		return nil, fmt.Errorf("unknown selection: %s", name)
+	}
+	p.pos++
+	return func(sel func(string) bool) bool { return sel(name) }, nil
+}
+
+// quantifier handles "1 of pattern" and "all of pattern", where pattern is "them" (every selection not
+// starting with an underscore) or a name with wildcards
+func (p *sigmaConditionParser) quantifier(all bool, pattern string) (sigmaCondition, error) {
+	var matched []string
+	re := sigmaWildcard(pattern)
+	for _, name := range p.names {
+		if (pattern == "them" && !strings.HasPrefix(name, "_")) || (pattern != "them" && re.MatchString(name)) {
+			matched = append(matched, name)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("no selections match %s", pattern)
+	}
+	return func(sel func(string) bool) bool {
+		for _, name := range matched {
+			if sel(name) != all {
+				return !all
+			}
+		}
+		return all
+	}, nil
+}
+
+func (p *sigmaConditionParser) hasName(name string) bool {
+	for _, n := range p.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
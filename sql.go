@@ -0,0 +1,805 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// sqlValue is one of nil (NULL), int64, float64, string, bool or time.Time
+type sqlValue interface{}
+
+// sqlContext is what expressions are evaluated against: a line, and when aggregating, the group it's in
+type sqlContext struct {
+	ll    *LogLine
+	group *sqlGroup
+}
+
+type sqlExpr func(ctx *sqlContext) sqlValue
+
+// sqlNode is a compiled expression, with what the query needs to know about how it was written
+type sqlNode struct {
+	eval sqlExpr
+	// text is the expression as written, used as its column heading
+	text string
+	// ident is set for a bare column name, and literal for a constant
+	ident   string
+	literal sqlValue
+	// agg is set if the expression contains an aggregate function
+	agg bool
+}
+
+// sqlKeywords can't be used as bare column names
+var sqlKeywords = map[string]bool{
+	"select": true, "distinct": true, "from": true, "where": true, "group": true, "by": true, "having": true,
+	"order": true, "asc": true, "desc": true, "limit": true, "offset": true, "and": true, "or": true, "not": true,
+	"like": true, "in": true, "is": true, "null": true, "between": true, "as": true, "true": true, "false": true,
+}
+
+// kinds of sqlToken
+const (
+	sqlTokenEOF = iota
+	sqlTokenIdent
+	sqlTokenNumber
+	sqlTokenString
+	sqlTokenOp
+)
+
+type sqlToken struct {
+	kind     int
+	text     string
+	pos, end int
+}
+
+// tokenizeSQL splits a query into identifiers, numbers, 'strings' and operators; "quoted" identifiers
+// may contain anything but a double quote
+func tokenizeSQL(src string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	i := 0
+	for i < len(src) {
+		r := rune(src[i])
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '_' || unicode.IsLetter(r):
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{sqlTokenIdent, src[start:i], start, i})
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1]))):
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{sqlTokenNumber, src[start:i], start, i})
+		case r == '\'':
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(src) {
+					return nil, fmt.Errorf("unterminated string starting at %d", start)
+				}
+				if src[i] == '\'' {
+					// '' is an escaped quote
+					if i+1 < len(src) && src[i+1] == '\'' {
+						b.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(src[i])
+				i++
+			}
+			tokens = append(tokens, sqlToken{sqlTokenString, b.String(), start, i})
+		case r == '"':
+			end := strings.IndexByte(src[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated identifier starting at %d", start)
+			}
+			i += end + 2
+			tokens = append(tokens, sqlToken{sqlTokenIdent, src[start+1 : i-1], start, i})
+		default:
+			op := src[i : i+1]
+			if i+1 < len(src) {
+				switch two := src[i : i+2]; two {
+				case "<=", ">=", "<>", "!=", "||":
+					op = two
+				}
+			}
+			if !strings.Contains("=<>!|+-*/%(),;", op[:1]) || op == "!" || op == "|" {
+				return nil, fmt.Errorf("unexpected %q at %d", op, start)
+			}
+			i += len(op)
+			tokens = append(tokens, sqlToken{sqlTokenOp, op, start, i})
+		}
+	}
+	return append(tokens, sqlToken{sqlTokenEOF, "", len(src), len(src)}), nil
+}
+
+type sqlParser struct {
+	src    string
+	tokens []sqlToken
+	pos    int
+
+	aggs  []*sqlAggregate
+	inAgg bool
+	// aliases are the named select columns, which ORDER BY, GROUP BY and HAVING can refer to
+	aliases map[string]*sqlNode
+}
+
+func (p *sqlParser) tok() sqlToken {
+	return p.tokens[p.pos]
+}
+
+// keyword reports whether the next token is the keyword kw, consuming it if so
+func (p *sqlParser) keyword(kw string) bool {
+	t := p.tok()
+	if t.kind == sqlTokenIdent && strings.EqualFold(t.text, kw) && p.src[t.pos] != '"' {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// op reports whether the next token is the operator op, consuming it if so
+func (p *sqlParser) op(op string) bool {
+	if t := p.tok(); t.kind == sqlTokenOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expect(what string, ok bool) error {
+	if ok {
+		return nil
+	}
+	if t := p.tok(); t.kind != sqlTokenEOF {
+		return fmt.Errorf("expected %s at %d, found %q", what, t.pos, t.text)
+	}
+	return fmt.Errorf("expected %s at end of query", what)
+}
+
+// parseExpr parses an expression, recording the text it was written as
+func (p *sqlParser) parseExpr() (*sqlNode, error) {
+	start := p.tok().pos
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	n.text = strings.TrimSpace(p.src[start:p.tokens[p.pos-1].end])
+	return n, nil
+}
+
+func (p *sqlParser) parseOr() (*sqlNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l, r := left.eval, right.eval
+		left = &sqlNode{agg: left.agg || right.agg, eval: func(ctx *sqlContext) sqlValue {
+			return sqlTruthy(l(ctx)) || sqlTruthy(r(ctx))
+		}}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) parseAnd() (*sqlNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l, r := left.eval, right.eval
+		left = &sqlNode{agg: left.agg || right.agg, eval: func(ctx *sqlContext) sqlValue {
+			return sqlTruthy(l(ctx)) && sqlTruthy(r(ctx))
+		}}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) parseNot() (*sqlNode, error) {
+	if p.keyword("not") {
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return negate(n), nil
+	}
+	return p.parseComparison()
+}
+
+func negate(n *sqlNode) *sqlNode {
+	e := n.eval
+	return &sqlNode{agg: n.agg, eval: func(ctx *sqlContext) sqlValue {
+		v := e(ctx)
+		if v == nil {
+			return nil
+		}
+		return !sqlTruthy(v)
+	}}
+}
+
+// sqlComparisons map comparison operators to what they want of sqlCompare's result
+var sqlComparisons = map[string]func(int) bool{
+	"=":  func(c int) bool { return c == 0 },
+	"!=": func(c int) bool { return c != 0 },
+	"<>": func(c int) bool { return c != 0 },
+	"<":  func(c int) bool { return c < 0 },
+	"<=": func(c int) bool { return c <= 0 },
+	">":  func(c int) bool { return c > 0 },
+	">=": func(c int) bool { return c >= 0 },
+}
+
+func (p *sqlParser) parseComparison() (*sqlNode, error) {
+	left, err := p.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.tok(); t.kind == sqlTokenOp && sqlComparisons[t.text] != nil {
+		p.pos++
+		right, err := p.parseConcat()
+		if err != nil {
+			return nil, err
+		}
+		test, l, r := sqlComparisons[t.text], left.eval, right.eval
+		return &sqlNode{agg: left.agg || right.agg, eval: func(ctx *sqlContext) sqlValue {
+			c, ok := sqlCompare(l(ctx), r(ctx))
+			if !ok {
+				return nil
+			}
+			return test(c)
+		}}, nil
+	}
+
+	if p.keyword("is") {
+		not := p.keyword("not")
+		if err := p.expect("NULL", p.keyword("null")); err != nil {
+			return nil, err
+		}
+		l := left.eval
+		return &sqlNode{agg: left.agg, eval: func(ctx *sqlContext) sqlValue { return (l(ctx) == nil) != not }}, nil
+	}
+
+	not := p.keyword("not")
+	var n *sqlNode
+	switch {
+	case p.keyword("like"):
+		n, err = p.parseLike(left)
+	case p.keyword("in"):
+		n, err = p.parseIn(left)
+	case p.keyword("between"):
+		n, err = p.parseBetween(left)
+	default:
+		if not {
+			return nil, p.expect("LIKE, IN or BETWEEN", false)
+		}
+		return left, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if not {
+		n = negate(n)
+	}
+	return n, nil
+}
+
+// parseLike parses the pattern of LIKE, where % matches anything and _ any one character, ignoring case
+func (p *sqlParser) parseLike(left *sqlNode) (*sqlNode, error) {
+	pattern, err := p.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	cache := map[string]*regexp.Regexp{}
+	l, r := left.eval, pattern.eval
+	return &sqlNode{agg: left.agg || pattern.agg, eval: func(ctx *sqlContext) sqlValue {
+		v, pv := l(ctx), r(ctx)
+		if v == nil || pv == nil {
+			return nil
+		}
+		ps := sqlString(pv)
+		re, ok := cache[ps]
+		if !ok {
+			re = sqlLikePattern(ps)
+			cache[ps] = re
+		}
+		return re.MatchString(sqlString(v))
+	}}, nil
+}
+
+func sqlLikePattern(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?is)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+func (p *sqlParser) parseIn(left *sqlNode) (*sqlNode, error) {
+	if err := p.expect("(", p.op("(")); err != nil {
+		return nil, err
+	}
+	var list []sqlExpr
+	agg := left.agg
+	for {
+		n, err := p.parseConcat()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, n.eval)
+		agg = agg || n.agg
+		if !p.op(",") {
+			break
+		}
+	}
+	if err := p.expect(")", p.op(")")); err != nil {
+		return nil, err
+	}
+	l := left.eval
+	return &sqlNode{agg: agg, eval: func(ctx *sqlContext) sqlValue {
+		v := l(ctx)
+		if v == nil {
+			return nil
+		}
+		for _, e := range list {
+			if c, ok := sqlCompare(v, e(ctx)); ok && c == 0 {
+				return true
+			}
+		}
+		return false
+	}}, nil
+}
+
+func (p *sqlParser) parseBetween(left *sqlNode) (*sqlNode, error) {
+	low, err := p.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("AND", p.keyword("and")); err != nil {
+		return nil, err
+	}
+	high, err := p.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	l, lo, hi := left.eval, low.eval, high.eval
+	return &sqlNode{agg: left.agg || low.agg || high.agg, eval: func(ctx *sqlContext) sqlValue {
+		v := l(ctx)
+		c1, ok1 := sqlCompare(v, lo(ctx))
+		c2, ok2 := sqlCompare(v, hi(ctx))
+		if !ok1 || !ok2 {
+			return nil
+		}
+		return c1 >= 0 && c2 <= 0
+	}}, nil
+}
+
+func (p *sqlParser) parseConcat() (*sqlNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for p.op("||") {
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		l, r := left.eval, right.eval
+		left = &sqlNode{agg: left.agg || right.agg, eval: func(ctx *sqlContext) sqlValue {
+			a, b := l(ctx), r(ctx)
+			if a == nil || b == nil {
+				return nil
+			}
+			return sqlString(a) + sqlString(b)
+		}}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) parseAdditive() (*sqlNode, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.tok().text
+		if p.tok().kind != sqlTokenOp || (op != "+" && op != "-") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = arithmetic(op, left, right)
+	}
+}
+
+func (p *sqlParser) parseMultiplicative() (*sqlNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.tok().text
+		if p.tok().kind != sqlTokenOp || (op != "*" && op != "/" && op != "%") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = arithmetic(op, left, right)
+	}
+}
+
+// arithmetic combines two numbers; / always divides exactly, so that ratios of counts come out right
+func arithmetic(op string, left *sqlNode, right *sqlNode) *sqlNode {
+	l, r := left.eval, right.eval
+	return &sqlNode{agg: left.agg || right.agg, eval: func(ctx *sqlContext) sqlValue {
+		a, aok := sqlNumeric(l(ctx))
+		b, bok := sqlNumeric(r(ctx))
+		if !aok || !bok {
+			return nil
+		}
+		ai, aInt := a.(int64)
+		bi, bInt := b.(int64)
+		if aInt && bInt {
+			switch op {
+			case "+":
+				return ai + bi
+			case "-":
+				return ai - bi
+			case "*":
+				return ai * bi
+			case "%":
+				if bi == 0 {
+					return nil
+				}
+				return ai % bi
+			}
+		}
+		af, bf := sqlFloat(a), sqlFloat(b)
+		switch op {
+		case "+":
+			return af + bf
+		case "-":
+			return af - bf
+		case "*":
+			return af * bf
+		case "/":
+			if bf == 0 {
+				return nil
+			}
+			return af / bf
+		}
+		if bf == 0 {
+			return nil
+		}
+		return math.Mod(af, bf)
+	}}
+}
+
+func (p *sqlParser) parseUnary() (*sqlNode, error) {
+	if p.op("-") {
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		e := n.eval
+		return &sqlNode{agg: n.agg, eval: func(ctx *sqlContext) sqlValue {
+			switch v := e(ctx).(type) {
+			case int64:
+				return -v
+			case float64:
+				return -v
+			}
+			return nil
+		}}, nil
+	}
+	p.op("+")
+	return p.parsePrimary()
+}
+
+func (p *sqlParser) parsePrimary() (*sqlNode, error) {
+	t := p.tok()
+	switch t.kind {
+	case sqlTokenNumber:
+		p.pos++
+		var v sqlValue
+		if i, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			v = i
+		} else if f, err := strconv.ParseFloat(t.text, 64); err == nil {
+			v = f
+		} else {
+			return nil, fmt.Errorf("invalid number at %d: %s", t.pos, t.text)
+		}
+		return sqlConstant(v), nil
+	case sqlTokenString:
+		p.pos++
+		return sqlConstant(t.text), nil
+	case sqlTokenOp:
+		if p.op("(") {
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")", p.op(")"))
+		}
+	case sqlTokenIdent:
+		switch {
+		case p.keyword("null"):
+			return sqlConstant(nil), nil
+		case p.keyword("true"):
+			return sqlConstant(true), nil
+		case p.keyword("false"):
+			return sqlConstant(false), nil
+		}
+		quoted := p.src[t.pos] == '"'
+		if !quoted && sqlKeywords[strings.ToLower(t.text)] {
+			break
+		}
+		p.pos++
+		if p.op("(") {
+			return p.parseCall(strings.ToLower(t.text), t.pos)
+		}
+		return p.column(t.text, t.pos)
+	}
+	return nil, p.expect("an expression", false)
+}
+
+func sqlConstant(v sqlValue) *sqlNode {
+	return &sqlNode{literal: v, eval: func(*sqlContext) sqlValue { return v }}
+}
+
+// column compiles a reference to a select column's alias or a log column
+func (p *sqlParser) column(name string, pos int) (*sqlNode, error) {
+	if alias, ok := p.aliases[strings.ToLower(name)]; ok {
+		return &sqlNode{eval: alias.eval, agg: alias.agg, ident: name}, nil
+	}
+	col, ok := sqlColumns[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown column at %d: %s (columns are %s)", pos, name, strings.Join(sqlColumnNames, ", "))
+	}
+	return &sqlNode{ident: strings.ToLower(name), eval: func(ctx *sqlContext) sqlValue {
+		if ctx.ll == nil {
+			return nil
+		}
+		return col(ctx.ll)
+	}}, nil
+}
+
+// parseCall parses the arguments of a function call, once its name and ( have been read
+func (p *sqlParser) parseCall(name string, pos int) (*sqlNode, error) {
+	if sqlAggregates[name] {
+		return p.parseAggregate(name, pos)
+	}
+	fn, ok := sqlFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function at %d: %s", pos, name)
+	}
+
+	var args []*sqlNode
+	if !p.op(")") {
+		for {
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, n)
+			if !p.op(",") {
+				break
+			}
+		}
+		if err := p.expect(")", p.op(")")); err != nil {
+			return nil, err
+		}
+	}
+	n, err := fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s at %d: %v", name, pos, err)
+	}
+	for _, a := range args {
+		n.agg = n.agg || a.agg
+	}
+	return n, nil
+}
+
+func (p *sqlParser) parseAggregate(name string, pos int) (*sqlNode, error) {
+	if p.inAgg {
+		return nil, fmt.Errorf("aggregate functions can't be nested, at %d", pos)
+	}
+	a := &sqlAggregate{name: name}
+	if name == "count" && p.op("*") {
+		a.star = true
+	} else {
+		a.distinct = p.keyword("distinct")
+		p.inAgg = true
+		arg, err := p.parseOr()
+		p.inAgg = false
+		if err != nil {
+			return nil, err
+		}
+		a.arg = arg.eval
+	}
+	if err := p.expect(")", p.op(")")); err != nil {
+		return nil, err
+	}
+
+	i := len(p.aggs)
+	p.aggs = append(p.aggs, a)
+	return &sqlNode{agg: true, eval: func(ctx *sqlContext) sqlValue {
+		if ctx.group == nil {
+			return nil
+		}
+		return ctx.group.accs[i].result(a)
+	}}, nil
+}
+
+// sqlTruthy reports whether v counts as true in WHERE and HAVING; NULL doesn't
+func sqlTruthy(v sqlValue) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case time.Time:
+		return !v.IsZero()
+	}
+	return false
+}
+
+// sqlNumeric returns v as an int64 or float64, converting strings that hold numbers
+func sqlNumeric(v sqlValue) (sqlValue, bool) {
+	switch v := v.(type) {
+	case int64, float64:
+		return v, true
+	case bool:
+		if v {
+			return int64(1), true
+		}
+		return int64(0), true
+	case string:
+		if i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			return i, true
+		}
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+func sqlFloat(v sqlValue) float64 {
+	switch v := v.(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// sqlString formats v for output and for string operations
+func sqlString(v sqlValue) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		// enough places for averages and ratios without printing floating point noise
+		return strconv.FormatFloat(math.Round(v*1000)/1000, 'f', -1, 64)
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
+
+// sqlCompare orders a and b: numbers by value, times by time (strings compared with times are read like
+// -since), and anything else as text. ok is false if either is NULL.
+func sqlCompare(a sqlValue, b sqlValue) (c int, ok bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+
+	at, aTime := a.(time.Time)
+	bt, bTime := b.(time.Time)
+	if aTime || bTime {
+		if !aTime {
+			if at, ok = sqlTime(a); !ok {
+				return strings.Compare(sqlString(a), sqlString(b)), true
+			}
+		}
+		if !bTime {
+			if bt, ok = sqlTime(b); !ok {
+				return strings.Compare(sqlString(a), sqlString(b)), true
+			}
+		}
+		switch {
+		case at.Before(bt):
+			return -1, true
+		case at.After(bt):
+			return 1, true
+		}
+		return 0, true
+	}
+
+	_, aStr := a.(string)
+	_, bStr := b.(string)
+	if !aStr || !bStr {
+		if an, ok := sqlNumeric(a); ok {
+			if bn, ok := sqlNumeric(b); ok {
+				ai, aInt := an.(int64)
+				bi, bInt := bn.(int64)
+				if aInt && bInt {
+					switch {
+					case ai < bi:
+						return -1, true
+					case ai > bi:
+						return 1, true
+					}
+					return 0, true
+				}
+				af, bf := sqlFloat(an), sqlFloat(bn)
+				switch {
+				case af < bf:
+					return -1, true
+				case af > bf:
+					return 1, true
+				}
+				return 0, true
+			}
+		}
+	}
+	return strings.Compare(sqlString(a), sqlString(b)), true
+}
+
+// sqlTime reads a string as a time the way -since does
+func sqlTime(v sqlValue) (time.Time, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := parseTimeBound(s, time.Now())
+	return t, err == nil
+}
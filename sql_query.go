@@ -0,0 +1,859 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sql output formats
+const (
+	sqlFormatTSV  = "tsv"
+	sqlFormatCSV  = "csv"
+	sqlFormatJSON = "json"
+)
+
+var sqlFormats = []string{sqlFormatTSV, sqlFormatCSV, sqlFormatJSON}
+
+// sqlColumns are the columns of the log table
+var sqlColumns = map[string]func(*LogLine) sqlValue{
+	"ip":   func(l *LogLine) sqlValue { return sqlIP(l.IP) },
+	"peer": func(l *LogLine) sqlValue { return sqlIP(l.Peer) },
+	"time": func(l *LogLine) sqlValue {
+		if l.Time.IsZero() {
+			return nil
+		}
+		return l.Time
+	},
+	"user": func(l *LogLine) sqlValue { return sqlText(l.User) },
+	"method": func(l *LogLine) sqlValue {
+		if l.Request == nil {
+			return nil
+		}
+		return sqlText(l.Request.Method)
+	},
+	"uri":   func(l *LogLine) sqlValue { return sqlText(sigmaURI(l)) },
+	"path":  func(l *LogLine) sqlValue { return sqlText(sigmaURIStem(l)) },
+	"query": func(l *LogLine) sqlValue { return sqlText(sigmaURIQuery(l)) },
+	"route": func(l *LogLine) sqlValue { return sqlText(requestRoute(l)) },
+	"proto": func(l *LogLine) sqlValue {
+		if l.Request == nil {
+			return nil
+		}
+		return sqlText(l.Request.Proto)
+	},
+	"host": func(l *LogLine) sqlValue {
+		if l.Request == nil {
+			return nil
+		}
+		return sqlText(l.Request.Host)
+	},
+	"status": func(l *LogLine) sqlValue {
+		if l.Status == 0 {
+			return nil
+		}
+		return l.Status
+	},
+	"bytes": func(l *LogLine) sqlValue { return l.BodyBytes },
+	"referer": func(l *LogLine) sqlValue {
+		if l.Referer == nil {
+			return nil
+		}
+		return sqlText(l.Referer.String())
+	},
+	"user_agent": func(l *LogLine) sqlValue { return sqlText(l.UserAgent) },
+	"request_time": func(l *LogLine) sqlValue {
+		if l.RequestTime == 0 {
+			return nil
+		}
+		return l.RequestTime.Seconds()
+	},
+	"country":      func(l *LogLine) sqlValue { return sqlGeo(l, "country") },
+	"country_name": func(l *LogLine) sqlValue { return sqlGeo(l, "country-name") },
+	"city":         func(l *LogLine) sqlValue { return sqlGeo(l, "city") },
+	"asn": func(l *LogLine) sqlValue {
+		if l.Geo == nil || l.Geo.ASN == 0 {
+			return nil
+		}
+		return int64(l.Geo.ASN)
+	},
+	"org":    func(l *LogLine) sqlValue { return sqlGeo(l, "org") },
+	"source": func(l *LogLine) sqlValue { return sqlText(l.Source) },
+	"level": func(l *LogLine) sqlValue {
+		if l.ErrorLog == nil {
+			return nil
+		}
+		return sqlText(l.ErrorLog.Level)
+	},
+	"message": func(l *LogLine) sqlValue {
+		if l.ErrorLog == nil {
+			return nil
+		}
+		return sqlText(l.ErrorLog.Message)
+	},
+	"raw": func(l *LogLine) sqlValue { return l.Raw },
+}
+
+// sqlColumnNames lists sqlColumns in the order SELECT * returns them
+var sqlColumnNames = []string{
+	"time", "ip", "user", "method", "uri", "path", "query", "route", "proto", "host", "status", "bytes", "referer",
+	"user_agent", "request_time", "peer", "country", "country_name", "city", "asn", "org", "source", "level",
+	"message", "raw",
+}
+
+func sqlIP(ip net.IP) sqlValue {
+	if ip == nil {
+		return nil
+	}
+	return ip.String()
+}
+
+// sqlText makes values that weren't logged NULL: the parsers leave most of them empty, but keep the "-"
+// the server wrote for users and user agents
+func sqlText(s string) sqlValue {
+	if s == "" || s == "-" {
+		return nil
+	}
+	return s
+}
+
+func sqlGeo(l *LogLine, field string) sqlValue {
+	if v := l.Geo.field(field); v != "-" {
+		return v
+	}
+	return nil
+}
+
+// sqlFunctions compile calls to scalar functions, given their arguments
+var sqlFunctions = map[string]func(args []*sqlNode) (*sqlNode, error){
+	"lower": sqlStringFunc(strings.ToLower),
+	"upper": sqlStringFunc(strings.ToUpper),
+	"length": func(args []*sqlNode) (*sqlNode, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("takes 1 argument")
+		}
+		arg := args[0].eval
+		return &sqlNode{eval: func(ctx *sqlContext) sqlValue {
+			v := arg(ctx)
+			if v == nil {
+				return nil
+			}
+			return int64(len(sqlString(v)))
+		}}, nil
+	},
+	"substr": func(args []*sqlNode) (*sqlNode, error) {
+		if len(args) != 2 && len(args) != 3 {
+			return nil, fmt.Errorf("takes 2 or 3 arguments")
+		}
+		return &sqlNode{eval: func(ctx *sqlContext) sqlValue {
+			v, start := args[0].eval(ctx), args[1].eval(ctx)
+			if v == nil || start == nil {
+				return nil
+			}
+			s := sqlString(v)
+			// positions count from 1, like SQL's
+			from, _ := sqlNumeric(start)
+			i := int(sqlFloat(from)) - 1
+			if i < 0 {
+				i = 0
+			}
+			if i > len(s) {
+				i = len(s)
+			}
+			s = s[i:]
+			if len(args) == 3 {
+				n, ok := sqlNumeric(args[2].eval(ctx))
+				if !ok {
+					return nil
+				}
+				if l := int(sqlFloat(n)); l >= 0 && l < len(s) {
+					s = s[:l]
+				}
+			}
+			return s
+		}}, nil
+	},
+	"coalesce": func(args []*sqlNode) (*sqlNode, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("takes at least 1 argument")
+		}
+		return &sqlNode{eval: func(ctx *sqlContext) sqlValue {
+			for _, a := range args {
+				if v := a.eval(ctx); v != nil {
+					return v
+				}
+			}
+			return nil
+		}}, nil
+	},
+	"in_cidr": func(args []*sqlNode) (*sqlNode, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("takes 2 arguments")
+		}
+		cidr, ok := args[1].literal.(string)
+		if !ok {
+			return nil, fmt.Errorf("the network must be a string like '10.0.0.0/8'")
+		}
+		network, err := parseIPOrCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ip := args[0].eval
+		return &sqlNode{eval: func(ctx *sqlContext) sqlValue {
+			v := ip(ctx)
+			if v == nil {
+				return nil
+			}
+			parsed := net.ParseIP(sqlString(v))
+			return parsed != nil && network.Contains(parsed)
+		}}, nil
+	},
+	// time_bucket('5m', time) rounds times down to a multiple of the interval
+	"time_bucket": func(args []*sqlNode) (*sqlNode, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("takes 2 arguments")
+		}
+		interval, ok := args[0].literal.(string)
+		if !ok {
+			return nil, fmt.Errorf("the interval must be a string like '5m'")
+		}
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid interval: %s", interval)
+		}
+		return sqlTimeFunc(args[1], func(t time.Time) time.Time { return t.Truncate(d) }), nil
+	},
+	// date_trunc('hour', time) rounds times down to the start of the unit, in the log's time zone
+	"date_trunc": func(args []*sqlNode) (*sqlNode, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("takes 2 arguments")
+		}
+		unit, _ := args[0].literal.(string)
+		trunc, ok := sqlDateUnits[strings.ToLower(unit)]
+		if !ok {
+			return nil, fmt.Errorf("the unit must be one of 'second', 'minute', 'hour', 'day', 'week', 'month' or 'year'")
+		}
+		return sqlTimeFunc(args[1], trunc), nil
+	},
+}
+
+var sqlDateUnits = map[string]func(time.Time) time.Time{
+	"second": func(t time.Time) time.Time { return t.Truncate(time.Second) },
+	"minute": func(t time.Time) time.Time { return t.Truncate(time.Minute) },
+	"hour": func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	},
+	"day": func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()) },
+	// weeks start on Monday
+	"week": func(t time.Time) time.Time {
+		days := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-days, 0, 0, 0, 0, t.Location())
+	},
+	"month": func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()) },
+	"year":  func(t time.Time) time.Time { return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location()) },
+}
+
+func sqlStringFunc(fn func(string) string) func(args []*sqlNode) (*sqlNode, error) {
+	return func(args []*sqlNode) (*sqlNode, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("takes 1 argument")
+		}
+		arg := args[0].eval
+		return &sqlNode{eval: func(ctx *sqlContext) sqlValue {
+			v := arg(ctx)
+			if v == nil {
+				return nil
+			}
+			return fn(sqlString(v))
+		}}, nil
+	}
+}
+
+func sqlTimeFunc(arg *sqlNode, fn func(time.Time) time.Time) *sqlNode {
+	return &sqlNode{eval: func(ctx *sqlContext) sqlValue {
+		v := arg.eval(ctx)
+		t, ok := v.(time.Time)
+		if !ok {
+			if t, ok = sqlTime(v); !ok {
+				return nil
+			}
+		}
+		return fn(t)
+	}}
+}
+
+// sqlAggregates are the aggregate functions
+var sqlAggregates = map[string]bool{"count": true, "sum": true, "avg": true, "min": true, "max": true}
+
+// sqlAggregate is one aggregate function call in a query
+type sqlAggregate struct {
+	name     string
+	arg      sqlExpr
+	star     bool
+	distinct bool
+}
+
+// sqlAccumulator holds one group's running state for one aggregate
+type sqlAccumulator struct {
+	count    int64
+	sumInt   int64
+	sumFloat float64
+	isFloat  bool
+	min, max sqlValue
+	seen     map[string]bool
+}
+
+func (acc *sqlAccumulator) add(a *sqlAggregate, ctx *sqlContext) {
+	if a.star {
+		acc.count++
+		return
+	}
+	v := a.arg(ctx)
+	if v == nil {
+		return
+	}
+	if a.distinct {
+		if acc.seen == nil {
+			acc.seen = map[string]bool{}
+		}
+		key := sqlKey(v)
+		if acc.seen[key] {
+			return
+		}
+		acc.seen[key] = true
+	}
+
+	acc.count++
+	switch a.name {
+	case "sum", "avg":
+		n, ok := sqlNumeric(v)
+		if !ok {
+			return
+		}
+		if i, ok := n.(int64); ok && !acc.isFloat {
+			acc.sumInt += i
+		} else {
+			if !acc.isFloat {
+				acc.sumFloat = float64(acc.sumInt)
+				acc.isFloat = true
+			}
+			acc.sumFloat += sqlFloat(n)
+		}
+	case "min":
+		if c, ok := sqlCompare(v, acc.min); !ok || c < 0 {
+			acc.min = v
+		}
+	case "max":
+		if c, ok := sqlCompare(v, acc.max); !ok || c > 0 {
+			acc.max = v
+		}
+	}
+}
+
+func (acc *sqlAccumulator) result(a *sqlAggregate) sqlValue {
+	switch a.name {
+	case "count":
+		return acc.count
+	case "sum":
+		if acc.count == 0 {
+			return nil
+		}
+		if acc.isFloat {
+			return acc.sumFloat
+		}
+		return acc.sumInt
+	case "avg":
+		if acc.count == 0 {
+			return nil
+		}
+		if acc.isFloat {
+			return acc.sumFloat / float64(acc.count)
+		}
+		return float64(acc.sumInt) / float64(acc.count)
+	case "min":
+		return acc.min
+	case "max":
+		return acc.max
+	}
+	return nil
+}
+
+// sqlKey turns v into a map key that tells apart values that print the same but compare differently
+func sqlKey(v sqlValue) string {
+	switch v := v.(type) {
+	case nil:
+		return "\x00"
+	case time.Time:
+		return "t" + strconv.FormatInt(v.UnixNano(), 10)
+	case int64:
+		return "n" + strconv.FormatInt(v, 10)
+	case float64:
+		return "n" + strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return "s" + sqlString(v)
+}
+
+// sqlGroup is the lines that share GROUP BY values; bare columns take their values from its first line
+type sqlGroup struct {
+	ll   *LogLine
+	accs []sqlAccumulator
+}
+
+type sqlOrder struct {
+	node *sqlNode
+	desc bool
+}
+
+// sqlRow is a result row waiting to be sorted
+type sqlRow struct {
+	values []sqlValue
+	keys   []sqlValue
+	seq    int
+}
+
+// sqlQuery is a compiled SELECT, fed lines one at a time. Queries without aggregates or ORDER BY print
+// rows as lines arrive; the rest print when finish is called.
+type sqlQuery struct {
+	columns  []*sqlNode
+	names    []string
+	distinct bool
+	where    *sqlNode
+	groupBy  []*sqlNode
+	having   *sqlNode
+	orderBy  []sqlOrder
+	limit    int
+	offset   int
+	aggs     []*sqlAggregate
+
+	groups  map[string]*sqlGroup
+	order   []*sqlGroup
+	rows    []sqlRow
+	seen    int
+	written bool // the header of the current batch of rows is out
+	headed  bool // a header has been printed at all
+	out     *sqlWriter
+}
+
+// parseSQL compiles a query like "SELECT ip, count(*) FROM log WHERE status >= 500 GROUP BY ip
+// ORDER BY 2 DESC LIMIT 10"
+func parseSQL(src string) (*sqlQuery, error) {
+	tokens, err := tokenizeSQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{src: src, tokens: tokens}
+	q := &sqlQuery{limit: -1, groups: map[string]*sqlGroup{}}
+
+	if err := p.expect("SELECT", p.keyword("select")); err != nil {
+		return nil, err
+	}
+	q.distinct = p.keyword("distinct")
+	aliases := map[string]*sqlNode{}
+	for {
+		if p.op("*") {
+			for _, name := range sqlColumnNames {
+				n, _ := p.column(name, 0)
+				q.columns = append(q.columns, n)
+				q.names = append(q.names, name)
+			}
+		} else {
+			n, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			name := n.text
+			if n.ident != "" {
+				name = n.ident
+			}
+			if p.keyword("as") || (p.tok().kind == sqlTokenIdent && !sqlKeywords[strings.ToLower(p.tok().text)]) {
+				t := p.tok()
+				if err := p.expect("a column name", t.kind == sqlTokenIdent); err != nil {
+					return nil, err
+				}
+				p.pos++
+				name = t.text
+				aliases[strings.ToLower(name)] = n
+			}
+			q.columns = append(q.columns, n)
+			q.names = append(q.names, name)
+		}
+		if !p.op(",") {
+			break
+		}
+	}
+
+	if p.keyword("from") {
+		t := p.tok()
+		if err := p.expect("log", t.kind == sqlTokenIdent && strings.EqualFold(t.text, "log")); err != nil {
+			return nil, err
+		}
+		p.pos++
+	}
+
+	if p.keyword("where") {
+		if q.where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+		if q.where.agg {
+			return nil, fmt.Errorf("aggregate functions can't be used in WHERE; use HAVING")
+		}
+	}
+
+	// later clauses can refer to select columns by name or position
+	p.aliases = aliases
+	if p.keyword("group") {
+		if err := p.expect("BY", p.keyword("by")); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := p.parseSelectRef(q)
+			if err != nil {
+				return nil, err
+			}
+			if n.agg {
+				return nil, fmt.Errorf("aggregate functions can't be used in GROUP BY")
+			}
+			q.groupBy = append(q.groupBy, n)
+			if !p.op(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("having") {
+		if q.having, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("order") {
+		if err := p.expect("BY", p.keyword("by")); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := p.parseSelectRef(q)
+			if err != nil {
+				return nil, err
+			}
+			o := sqlOrder{node: n}
+			if p.keyword("desc") {
+				o.desc = true
+			} else {
+				p.keyword("asc")
+			}
+			q.orderBy = append(q.orderBy, o)
+			if !p.op(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("limit") {
+		if q.limit, err = p.parseCount("LIMIT"); err != nil {
+			return nil, err
+		}
+		if p.keyword("offset") {
+			if q.offset, err = p.parseCount("OFFSET"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	p.op(";")
+	if err := p.expect("end of query", p.tok().kind == sqlTokenEOF); err != nil {
+		return nil, err
+	}
+
+	q.aggs = p.aggs
+	if q.having != nil && !q.aggregating() {
+		return nil, fmt.Errorf("HAVING needs GROUP BY or an aggregate function")
+	}
+	return q, nil
+}
+
+// parseSQLWhere compiles an expression like those WHERE takes, for filtering lines outside a full query
+func parseSQLWhere(src string) (*sqlNode, error) {
+	tokens, err := tokenizeSQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{src: src, tokens: tokens}
+	n, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("end of expression", p.tok().kind == sqlTokenEOF); err != nil {
+		return nil, err
+	}
+	if n.agg {
+		return nil, fmt.Errorf("aggregate functions can't be used in WHERE")
+	}
+	return n, nil
+}
+
+// parseSelectRef parses an expression in GROUP BY or ORDER BY, where a number picks a select column
+func (p *sqlParser) parseSelectRef(q *sqlQuery) (*sqlNode, error) {
+	n, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if i, ok := n.literal.(int64); ok {
+		if i < 1 || int(i) > len(q.columns) {
+			return nil, fmt.Errorf("column %d is out of range", i)
+		}
+		return q.columns[i-1], nil
+	}
+	return n, nil
+}
+
+func (p *sqlParser) parseCount(clause string) (int, error) {
+	t := p.tok()
+	n, err := strconv.Atoi(t.text)
+	if t.kind != sqlTokenNumber || err != nil || n < 0 {
+		return 0, p.expect("a count after "+clause, false)
+	}
+	p.pos++
+	return n, nil
+}
+
+// aggregating reports whether the query's rows are groups of lines rather than lines
+func (q *sqlQuery) aggregating() bool {
+	return len(q.aggs) > 0 || len(q.groupBy) > 0 || q.distinct
+}
+
+// full reports whether the query has printed every row it's going to, so no more lines need reading
+func (q *sqlQuery) full() bool {
+	return !q.aggregating() && len(q.orderBy) == 0 && q.limit >= 0 && q.seen >= q.offset+q.limit
+}
+
+// add feeds a line through the query
+func (q *sqlQuery) add(ll *LogLine) {
+	ctx := &sqlContext{ll: ll}
+	if q.where != nil && !sqlTruthy(q.where.eval(ctx)) {
+		return
+	}
+	if !q.aggregating() {
+		q.emit(ctx)
+		return
+	}
+
+	// DISTINCT without GROUP BY groups by everything selected
+	keyNodes := q.groupBy
+	if len(keyNodes) == 0 && q.distinct {
+		keyNodes = q.columns
+	}
+	var key strings.Builder
+	for _, n := range keyNodes {
+		key.WriteString(sqlKey(n.eval(ctx)))
+		key.WriteByte(0)
+	}
+	g, ok := q.groups[key.String()]
+	if !ok {
+		g = &sqlGroup{ll: ll, accs: make([]sqlAccumulator, len(q.aggs))}
+		q.groups[key.String()] = g
+		q.order = append(q.order, g)
+	}
+	ctx.group = g
+	for i, a := range q.aggs {
+		g.accs[i].add(a, ctx)
+	}
+}
+
+// emit produces the row for ctx, printing it straight away unless it has to be sorted first
+func (q *sqlQuery) emit(ctx *sqlContext) {
+	if len(q.orderBy) == 0 {
+		q.seen++
+		if q.seen <= q.offset || (q.limit >= 0 && q.seen > q.offset+q.limit) {
+			return
+		}
+		q.write(q.values(ctx))
+		return
+	}
+
+	row := sqlRow{values: q.values(ctx), seq: len(q.rows)}
+	for _, o := range q.orderBy {
+		row.keys = append(row.keys, o.node.eval(ctx))
+	}
+	q.rows = append(q.rows, row)
+	// with a LIMIT, only the rows that could still make the cut need keeping
+	if q.limit >= 0 && len(q.rows) > 2*(q.offset+q.limit)+1024 {
+		q.sortRows()
+		q.rows = q.rows[:q.offset+q.limit]
+	}
+}
+
+func (q *sqlQuery) values(ctx *sqlContext) []sqlValue {
+	values := make([]sqlValue, len(q.columns))
+	for i, n := range q.columns {
+		values[i] = n.eval(ctx)
+	}
+	return values
+}
+
+func (q *sqlQuery) sortRows() {
+	sort.SliceStable(q.rows, func(i, j int) bool {
+		a, b := q.rows[i], q.rows[j]
+		for k, o := range q.orderBy {
+			c, ok := sqlCompare(a.keys[k], b.keys[k])
+			if !ok {
+				// NULLs sort first
+				switch {
+				case a.keys[k] == nil && b.keys[k] == nil:
+					c = 0
+				case a.keys[k] == nil:
+					c = -1
+				default:
+					c = 1
+				}
+			}
+			if o.desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return a.seq < b.seq
+	})
+}
+
+// finish prints the rows that had to wait for the last line: groups, and anything sorted. When it's called
+// periodically, groups are printed afresh each time, and sorted rows only once, in the batch they arrived in.
+func (q *sqlQuery) finish() {
+	if q.aggregating() {
+		groups := q.order
+		// aggregates over no lines at all still make a row
+		if len(groups) == 0 && len(q.groupBy) == 0 && !q.distinct {
+			groups = []*sqlGroup{{accs: make([]sqlAccumulator, len(q.aggs))}}
+		}
+		q.rows, q.seen = nil, 0
+		for _, g := range groups {
+			ctx := &sqlContext{ll: g.ll, group: g}
+			if q.having != nil && !sqlTruthy(q.having.eval(ctx)) {
+				continue
+			}
+			q.emit(ctx)
+		}
+		// groups can keep growing when the summary is printed periodically
+		q.seen = 0
+	}
+
+	if len(q.orderBy) > 0 {
+		q.sortRows()
+		rows := q.rows
+		if q.offset < len(rows) {
+			rows = rows[q.offset:]
+		} else {
+			rows = nil
+		}
+		if q.limit >= 0 && q.limit < len(rows) {
+			rows = rows[:q.limit]
+		}
+		for _, r := range rows {
+			q.write(r.values)
+		}
+	}
+
+	// an empty result still gets a header, but later empty batches print nothing
+	if !q.written && !q.headed {
+		q.out.writeHeader(q.names)
+		q.headed = true
+	}
+	q.out.flush()
+	if q.aggregating() || len(q.orderBy) > 0 {
+		q.rows = nil
+		q.written = false
+	}
+}
+
+func (q *sqlQuery) write(values []sqlValue) {
+	if !q.written {
+		q.out.writeHeader(q.names)
+		q.written, q.headed = true, true
+	}
+	q.out.writeRow(q.names, values)
+}
+
+// sqlWriter prints result rows as tab-separated values, CSV or JSON lines
+type sqlWriter struct {
+	format string
+	header bool
+	w      *bufio.Writer
+	csv    *csv.Writer
+}
+
+func newSQLWriter(w io.Writer, format string, header bool) *sqlWriter {
+	s := &sqlWriter{format: format, header: header, w: bufio.NewWriter(w)}
+	s.csv = csv.NewWriter(s.w)
+	return s
+}
+
+func (s *sqlWriter) writeHeader(names []string) {
+	if !s.header {
+		return
+	}
+	switch s.format {
+	case sqlFormatCSV:
+		_ = s.csv.Write(names)
+	case sqlFormatTSV:
+		fmt.Fprintln(s.w, strings.Join(names, "\t"))
+	}
+}
+
+func (s *sqlWriter) writeRow(names []string, values []sqlValue) {
+	switch s.format {
+	case sqlFormatCSV:
+		record := make([]string, len(values))
+		for i, v := range values {
+			record[i] = sqlString(v)
+		}
+		_ = s.csv.Write(record)
+	case sqlFormatJSON:
+		s.w.WriteByte('{')
+		for i, v := range values {
+			if i > 0 {
+				s.w.WriteByte(',')
+			}
+			name, _ := json.Marshal(names[i])
+			s.w.Write(name)
+			s.w.WriteByte(':')
+			s.w.Write(sqlJSON(v))
+		}
+		s.w.WriteString("}\n")
+	default:
+		fields := make([]string, len(values))
+		for i, v := range values {
+			if v == nil {
+				fields[i] = "-"
+			} else {
+				fields[i] = strings.NewReplacer("\t", " ", "\n", " ").Replace(sqlString(v))
+			}
+		}
+		fmt.Fprintln(s.w, strings.Join(fields, "\t"))
+	}
+	// rows printed as lines arrive shouldn't sit in the buffer
+	s.flush()
+}
+
+func (s *sqlWriter) flush() {
+	s.csv.Flush()
+	_ = s.w.Flush()
+}
+
+func sqlJSON(v sqlValue) []byte {
+	switch v := v.(type) {
+	case time.Time:
+		data, _ := json.Marshal(v.Format(time.RFC3339))
+		return data
+	case float64:
+		return []byte(sqlString(v))
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return []byte("null")
+	}
+	return data
+}
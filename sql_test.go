@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var sqlTestLines = []string{
+	`10.0.0.1 - - [10/Oct/2023:13:55:36 +0000] "GET /a?x=1 HTTP/1.1" 200 100 "-" "curl/8.0"`,
+	`10.0.0.2 - - [10/Oct/2023:13:58:01 +0000] "GET /b HTTP/1.1" 404 0 "https://example.com/" "Mozilla/5.0"`,
+	`10.0.0.1 - - [10/Oct/2023:14:01:10 +0000] "POST /a HTTP/1.1" 500 50 "-" "curl/8.0"`,
+	`10.0.0.3 - bob [10/Oct/2023:14:02:00 +0000] "GET /c/123 HTTP/1.1" 200 300 "-" "Mozilla/5.0"`,
+	`10.0.0.2 - - [10/Oct/2023:14:05:59 +0000] "GET /a HTTP/1.1" 200 100 "-" "Mozilla/5.0"`,
+}
+
+// runSQL runs src over sqlTestLines, returning its rows as tab-separated values without the header
+func runSQL(t *testing.T, src string) string {
+	t.Helper()
+	q, err := parseSQL(src)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	var out bytes.Buffer
+	q.out = newSQLWriter(&out, sqlFormatTSV, false)
+	parser := logFormats["combined"]()
+	for _, line := range sqlTestLines {
+		ll, err := parser.ParseLine(line)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		ll.Raw = line
+		if q.full() {
+			break
+		}
+		q.add(ll)
+	}
+	q.finish()
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+func TestSQLQuery(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"SELECT ip, status FROM log WHERE status >= 400", []string{"10.0.0.2\t404", "10.0.0.1\t500"}},
+		{"SELECT path WHERE ip = '10.0.0.1' AND method = 'GET'", []string{"/a"}},
+		{"SELECT ip LIMIT 2 OFFSET 1", []string{"10.0.0.2", "10.0.0.1"}},
+		{"SELECT status + 1, bytes / 2, bytes * 1.5 LIMIT 1", []string{"201\t50\t150"}},
+		{"SELECT path || '!' WHERE path LIKE '/c/%'", []string{"/c/123!"}},
+		{"SELECT ip WHERE status IN (404, 500) AND NOT path = '/b'", []string{"10.0.0.1"}},
+		{"SELECT bytes WHERE bytes BETWEEN 50 AND 100", []string{"100", "50", "100"}},
+		{"SELECT upper(method), length(path), substr(path, 2, 1) WHERE status = 404", []string{"GET\t2\tb"}},
+		{"SELECT ip WHERE in_cidr(ip, '10.0.0.2/31') AND time >= '2023-10-10 14:00'", []string{"10.0.0.3", "10.0.0.2"}},
+
+		// NULLs: unlogged values are NULL, match nothing, and aren't counted
+		{"SELECT user, referer LIMIT 1", []string{"-\t-"}},
+		{"SELECT ip WHERE user IS NOT NULL", []string{"10.0.0.3"}},
+		{"SELECT ip WHERE referer = 'x' OR NOT referer = 'x'", []string{"10.0.0.2"}},
+		{"SELECT count(*), count(referer), count(DISTINCT ip), coalesce(max(user), 'none')", []string{"5\t1\t3\tbob"}},
+		{"SELECT count(*), sum(bytes), min(status) WHERE status = 999", []string{"0\t-\t-"}},
+
+		// grouping, aliases, and ORDER BY name, alias and position
+		{"SELECT ip, count(*) AS n GROUP BY ip ORDER BY n DESC, ip", []string{"10.0.0.1\t2", "10.0.0.2\t2", "10.0.0.3\t1"}},
+		{"SELECT path, sum(bytes) GROUP BY 1 ORDER BY 2 DESC LIMIT 2", []string{"/c/123\t300", "/a\t250"}},
+		{"SELECT path, sum(bytes) AS total GROUP BY path ORDER BY total, path LIMIT 2", []string{"/b\t0", "/a\t250"}},
+		{"SELECT ip, avg(bytes) GROUP BY ip HAVING count(*) > 1 ORDER BY ip", []string{"10.0.0.1\t75", "10.0.0.2\t50"}},
+		{"SELECT DISTINCT user_agent ORDER BY user_agent", []string{"Mozilla/5.0", "curl/8.0"}},
+		{"SELECT DISTINCT status ORDER BY 1 DESC LIMIT 1 OFFSET 1", []string{"404"}},
+		{"SELECT ip ORDER BY bytes DESC, time LIMIT 2", []string{"10.0.0.3", "10.0.0.1"}},
+
+		// time buckets
+		{"SELECT time_bucket('1h', time) AS hour, count(*) GROUP BY 1 ORDER BY 1", []string{"2023-10-10T13:00:00Z\t2", "2023-10-10T14:00:00Z\t3"}},
+		{"SELECT date_trunc('minute', time), ip WHERE status = 500", []string{"2023-10-10T14:01:00Z\t10.0.0.1"}},
+	}
+	for _, test := range tests {
+		if got, want := runSQL(t, test.src), strings.Join(test.want, "\n"); got != want {
+			t.Errorf("%s:\ngot:\n%s\nwant:\n%s", test.src, got, want)
+		}
+	}
+}
+
+func TestParseSQLErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"ip, status", "SELECT"},
+		{"SELECT nope", "nope"},
+		{"SELECT ip FROM other", "log"},
+		{"SELECT ip WHERE count(*) > 1", "HAVING"},
+		{"SELECT ip GROUP BY count(*)", "GROUP BY"},
+		{"SELECT ip HAVING status > 1", "GROUP BY"},
+		{"SELECT ip ORDER BY 3", "3"},
+		{"SELECT ip LIMIT -1", "LIMIT"},
+		{"SELECT time_bucket('soon', time)", "interval"},
+		{"SELECT ip WHERE path = 'unterminated", "unterminated"},
+		{"SELECT ip status bytes", "end of query"},
+	}
+	for _, test := range tests {
+		_, err := parseSQL(test.src)
+		if err == nil {
+			t.Errorf("%s: no error, want one mentioning %q", test.src, test.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %q, want one mentioning %q", test.src, err, test.want)
+		}
+	}
+}
+
+func TestSQLQueryFull(t *testing.T) {
+	tests := []struct {
+		src  string
+		full bool
+	}{
+		{"SELECT ip LIMIT 2", true},
+		{"SELECT ip LIMIT 1 OFFSET 1", true},
+		{"SELECT ip LIMIT 10", false},
+		{"SELECT ip", false},
+		// sorting and grouping need every line, whatever the limit
+		{"SELECT ip ORDER BY ip LIMIT 1", false},
+		{"SELECT ip, count(*) GROUP BY ip LIMIT 1", false},
+		{"SELECT DISTINCT ip LIMIT 1", false},
+	}
+	for _, test := range tests {
+		q, err := parseSQL(test.src)
+		if err != nil {
+			t.Fatalf("%s: %v", test.src, err)
+		}
+		q.out = newSQLWriter(&bytes.Buffer{}, sqlFormatTSV, false)
+		parser := logFormats["combined"]()
+		for _, line := range sqlTestLines[:2] {
+			ll, err := parser.ParseLine(line)
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			q.add(ll)
+		}
+		if q.full() != test.full {
+			t.Errorf("%s: full() = %v after 2 lines, want %v", test.src, q.full(), test.full)
+		}
+	}
+}
+
+// TestSQLQueryFinishTwice checks what listen -interval prints when it calls finish periodically
+func TestSQLQueryFinishTwice(t *testing.T) {
+	tests := []struct {
+		src         string
+		first, then string
+	}{
+		// sorted rows print once, in the batch they arrived in
+		{"SELECT status ORDER BY status", "200\n404\n", "200\n200\n500\n"},
+		// groups are printed afresh with everything so far
+		{"SELECT count(*)", "2\n", "5\n"},
+		// rows printed as they arrived aren't printed again
+		{"SELECT status", "200\n404\n", "500\n200\n200\n"},
+	}
+	parser := logFormats["combined"]()
+	for _, test := range tests {
+		q, err := parseSQL(test.src)
+		if err != nil {
+			t.Fatalf("%s: %v", test.src, err)
+		}
+		var out bytes.Buffer
+		q.out = newSQLWriter(&out, sqlFormatTSV, false)
+		for i, line := range sqlTestLines {
+			if i == 2 {
+				q.finish()
+				if out.String() != test.first {
+					t.Errorf("%s: first finish printed %q, want %q", test.src, out.String(), test.first)
+				}
+				out.Reset()
+			}
+			ll, err := parser.ParseLine(line)
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			q.add(ll)
+		}
+		q.finish()
+		if out.String() != test.then {
+			t.Errorf("%s: second finish printed %q, want %q", test.src, out.String(), test.then)
+		}
+	}
+}
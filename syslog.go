@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+var syslog3164TimeFormat = "Jan _2 15:04:05"
+
+// SyslogInfo holds the values from the syslog header a line arrived with
+type SyslogInfo struct {
+	Priority  int // -1 if the header had none, as when read back from a syslog daemon's files
+	Facility  int
+	Severity  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+}
+
+// SyslogParser strips RFC 3164 / RFC 5424 headers and hands the remainder to another LineParser; lines
+// without a recognizable header are passed through untouched
+type SyslogParser struct {
+	next LineParser
+}
+
+// NewSyslogParser returns a *SyslogParser wrapping next
+func NewSyslogParser(next LineParser) *SyslogParser {
+	return &SyslogParser{next: next}
+}
+
+// withSyslog wraps a log format's LineParser constructor with a *SyslogParser
+func withSyslog(newParser func() LineParser) func() LineParser {
+	return func() LineParser {
+		return NewSyslogParser(newParser())
+	}
+}
+
+// ParseLine records the syslog header, if any, on the *LogLine parsed from the rest of input
+func (s *SyslogParser) ParseLine(input string) (*LogLine, error) {
+	info, rest, ok := parseSyslogHeader(input)
+	if !ok {
+		return s.next.ParseLine(input)
+	}
+	ll, err := s.next.ParseLine(rest)
+	if ll != nil {
+		ll.Syslog = info
+		ll.shiftSpans(len(input) - len(rest))
+	}
+	return ll, err
+}
+
+// parseSyslogHeader splits input into its syslog header and message; ok is false if there's no header
+func parseSyslogHeader(input string) (info *SyslogInfo, msg string, ok bool) {
+	info = &SyslogInfo{Priority: -1}
+	rest := input
+
+	if strings.HasPrefix(rest, "<") {
+		end := strings.IndexRune(rest, '>')
+		if end < 0 {
+			return nil, "", false
+		}
+		pri, err := strconv.Atoi(rest[1:end])
+		if err != nil || pri < 0 || pri > 191 {
+			return nil, "", false
+		}
+		info.Priority, info.Facility, info.Severity = pri, pri/8, pri%8
+		rest = rest[end+1:]
+	}
+
+	if strings.HasPrefix(rest, "1 ") {
+		msg, ok = parseSyslog5424(info, rest[2:])
+	} else {
+		msg, ok = parseSyslog3164(info, rest)
+	}
+	if !ok {
+		return nil, "", false
+	}
+	return info, msg, true
+}
+
+// parseSyslog5424 parses TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func parseSyslog5424(info *SyslogInfo, rest string) (string, bool) {
+	parts := strings.SplitN(rest, " ", 6)
+	if len(parts) != 6 {
+		return "", false
+	}
+
+	if parts[0] != "-" {
+		t, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return "", false
+		}
+		info.Timestamp = t
+	}
+	info.Hostname = syslogNil(parts[1])
+	info.AppName = syslogNil(parts[2])
+	info.ProcID = syslogNil(parts[3])
+
+	// structured data is either "-" or one or more [id key="value"...] elements, which may contain spaces
+	sd := parts[5]
+	if strings.HasPrefix(sd, "-") {
+		sd = sd[1:]
+	} else {
+		for strings.HasPrefix(sd, "[") {
+			end := syslogSDEnd(sd)
+			if end < 0 {
+				return "", false
+			}
+			sd = sd[end+1:]
+		}
+	}
+
+	msg := strings.TrimPrefix(sd, " ")
+	return strings.TrimPrefix(msg, "\ufeff"), true
+}
+
+// syslogSDEnd returns the index of the ']' closing the structured data element at the start of sd
+func syslogSDEnd(sd string) int {
+	inQuotes := false
+	for i := 1; i < len(sd); i++ {
+		switch sd[i] {
+		case '\\':
+			i++
+		case '"':
+			inQuotes = !inQuotes
+		case ']':
+			if !inQuotes {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// parseSyslog3164 parses "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG"; relays sometimes drop the hostname
+func parseSyslog3164(info *SyslogInfo, rest string) (string, bool) {
+	if len(rest) < len(syslog3164TimeFormat)+1 || rest[len(syslog3164TimeFormat)] != ' ' {
+		return "", false
+	}
+	t, err := time.ParseInLocation(syslog3164TimeFormat, rest[:len(syslog3164TimeFormat)], time.Local)
+	if err != nil {
+		return "", false
+	}
+	info.Timestamp = syslogYear(t, time.Now())
+	rest = rest[len(syslog3164TimeFormat)+1:]
+
+	fields := strings.SplitN(rest, " ", 3)
+	if len(fields) < 2 {
+		return "", false
+	}
+	if !strings.HasSuffix(fields[0], ":") {
+		info.Hostname = fields[0]
+		rest = strings.Join(fields[1:], " ")
+	}
+
+	end := strings.Index(rest, ": ")
+	if end < 0 {
+		return "", false
+	}
+	tag := rest[:end]
+	if i := strings.IndexRune(tag, '['); i >= 0 && strings.HasSuffix(tag, "]") {
+		info.ProcID = tag[i+1 : len(tag)-1]
+		tag = tag[:i]
+	}
+	info.AppName = tag
+
+	return rest[end+2:], true
+}
+
+// syslogYear fills in the year RFC 3164 timestamps leave out, assuming they aren't from the future
+func syslogYear(t time.Time, now time.Time) time.Time {
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
+
+// syslogNil converts RFC 5424's "-" NILVALUE to an empty string
+func syslogNil(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+)
+
+// terminal is the controlling terminal, put into a mode where keys arrive as they're pressed and the
+// screen can be redrawn in place. It's driven through stty so that it works on any Unix without cgo.
+type terminal struct {
+	tty     *os.File
+	saved   string
+	pending []byte
+}
+
+// openTerminal takes over /dev/tty, which works even when STDIN is a log
+func openTerminal() (*terminal, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("no terminal to draw on: %v", err)
+	}
+	t := &terminal{tty: tty}
+	if t.saved, err = t.stty("-g"); err != nil {
+		tty.Close()
+		return nil, err
+	}
+	if _, err := t.stty("-icanon", "-echo", "min", "1"); err != nil {
+		tty.Close()
+		return nil, err
+	}
+	// switch to the alternate screen and hide the cursor
+	fmt.Fprint(tty, "\x1b[?1049h\x1b[?25l")
+	return t, nil
+}
+
+func (t *terminal) stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = t.tty
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("stty %s: %v", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// size returns the terminal's width and height, or 80x24 if it can't be found
+func (t *terminal) size() (width int, height int) {
+	out, err := t.stty("size")
+	if err == nil {
+		if _, err := fmt.Sscan(out, &height, &width); err == nil && width > 0 && height > 0 {
+			return width, height
+		}
+	}
+	return 80, 24
+}
+
+// terminalKeys names the multi-byte sequences terminals send for special keys
+var terminalKeys = map[string]string{
+	"\x1b[A": "up", "\x1bOA": "up",
+	"\x1b[B": "down", "\x1bOB": "down",
+	"\x1b[C": "right", "\x1bOC": "right",
+	"\x1b[D": "left", "\x1bOD": "left",
+	"\x1b[Z": "backtab",
+}
+
+// readKey blocks until a key is pressed, returning special keys by name: "up", "down", "left", "right",
+// "enter", "backspace", "tab" and "backtab". Keys that arrive together are returned one at a time.
+func (t *terminal) readKey() (string, error) {
+	if len(t.pending) == 0 {
+		buf := make([]byte, 64)
+		n, err := t.tty.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		t.pending = buf[:n]
+	}
+
+	if len(t.pending) >= 3 {
+		if name, ok := terminalKeys[string(t.pending[:3])]; ok {
+			t.pending = t.pending[3:]
+			return name, nil
+		}
+	}
+	r, size := utf8.DecodeRune(t.pending)
+	t.pending = t.pending[size:]
+	switch r {
+	case '\r', '\n':
+		return "enter", nil
+	case 0x7f, '\b':
+		return "backspace", nil
+	case '\t':
+		return "tab", nil
+	}
+	return string(r), nil
+}
+
+// restore puts the terminal back the way it was found
+func (t *terminal) restore() {
+	fmt.Fprint(t.tty, "\x1b[?25h\x1b[?1049l")
+	_, _ = t.stty(t.saved)
+	t.tty.Close()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// seekSlack widens the part of a file that's binary searched for, since lines are logged slightly out of
+// order (nginx logs when a request finishes, but with the time it started)
+const seekSlack = 5 * time.Minute
+
+// seekProbeLines is how many lines past a probe point are tried before giving up on finding a timestamp
+const seekProbeLines = 100
+
+// timeBoundFormats are the absolute times -since and -until accept; those without a zone are local time
+var timeBoundFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	nginxTimeFormat,
+	"02/Jan/2006:15:04:05",
+}
+
+// parseTimeBound parses an absolute time in one of timeBoundFormats, or a duration before now like -2h
+// (the minus sign is optional), or "now"
+func parseTimeBound(s string, now time.Time) (time.Time, error) {
+	if s == "now" {
+		return now, nil
+	}
+	if d, err := time.ParseDuration(strings.TrimPrefix(s, "-")); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, format := range timeBoundFormats {
+		if t, err := time.ParseInLocation(format, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %s", s)
+}
+
+// timeRange holds the -since and -until bounds; a zero bound is open
+type timeRange struct {
+	since, until time.Time
+}
+
+func (r timeRange) empty() bool {
+	return r.since.IsZero() && r.until.IsZero()
+}
+
+// contains reports whether t is at or after since and before until
+func (r timeRange) contains(t time.Time) bool {
+	if !r.since.IsZero() && t.Before(r.since) {
+		return false
+	}
+	if !r.until.IsZero() && !t.Before(r.until) {
+		return false
+	}
+	return true
+}
+
+// seekTimeRange returns the part of f that can hold lines in r, found by binary search on the timestamps
+// of lines parsed with a LineParser from newParser. It only works on regular files whose lines are in
+// time order (give or take seekSlack); anything else is returned whole.
+func seekTimeRange(f *os.File, newParser func() LineParser, r timeRange) (io.Reader, error) {
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return f, nil
+	}
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return f, nil
+	}
+
+	s := &timeSeeker{f: f, parser: newParser(), start: start, size: info.Size()}
+	from, to := start, s.size
+	if !r.since.IsZero() {
+		if from, err = s.firstAtOrAfter(r.since.Add(-seekSlack)); err != nil {
+			return nil, err
+		}
+	}
+	if !r.until.IsZero() {
+		if to, err = s.firstAtOrAfter(r.until.Add(seekSlack)); err != nil {
+			return nil, err
+		}
+	}
+	if to < from {
+		to = from
+	}
+	return io.NewSectionReader(f, from, to-from), nil
+}
+
+// timeSeeker probes a file for the timestamps of the lines at various offsets
+type timeSeeker struct {
+	f      *os.File
+	parser LineParser
+	start  int64
+	size   int64
+}
+
+// firstAtOrAfter returns the offset of the first line whose time is t or later, or the end of the file
+func (s *timeSeeker) firstAtOrAfter(t time.Time) (int64, error) {
+	atOrAfter := func(pos int64) (bool, error) {
+		lineTime, err := s.timeAt(pos)
+		if err != nil {
+			return false, err
+		}
+		// no timestamp found before the end: treat it like the end of the file
+		return lineTime.IsZero() || !lineTime.Before(t), nil
+	}
+
+	if ok, err := atOrAfter(s.start); err != nil || ok {
+		return s.start, err
+	}
+	lo, hi := s.start, s.size
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		ok, err := atOrAfter(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return s.lineStart(hi)
+}
+
+// lineStart returns the offset of the first line that starts at or after pos
+func (s *timeSeeker) lineStart(pos int64) (int64, error) {
+	if pos <= s.start {
+		return s.start, nil
+	}
+	if pos >= s.size {
+		return s.size, nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(s.f, pos-1, s.size-pos+1))
+	n, err := skipLine(r)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	return pos - 1 + n, nil
+}
+
+// timeAt returns the time of the first line with one that starts at or after pos, or the zero time if
+// there's none within seekProbeLines lines
+func (s *timeSeeker) timeAt(pos int64) (time.Time, error) {
+	offset, err := s.lineStart(pos)
+	if err != nil {
+		return time.Time{}, err
+	}
+	r := bufio.NewReader(io.NewSectionReader(s.f, offset, s.size-offset))
+	for i := 0; i < seekProbeLines; i++ {
+		line, _, err := readLine(r, *maxLineLength)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return time.Time{}, err
+		}
+		if ll, _ := s.parser.ParseLine(line); ll != nil && !ll.Time.IsZero() {
+			return ll.Time, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// skipLine reads through the next newline, returning how many bytes that took
+func skipLine(r *bufio.Reader) (int64, error) {
+	var n int64
+	for {
+		frag, err := r.ReadSlice('\n')
+		n += int64(len(frag))
+		if err != bufio.ErrBufferFull {
+			return n, err
+		}
+	}
+}
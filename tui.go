@@ -0,0 +1,672 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// tuiRefresh is how often the dashboard is redrawn while lines are arriving
+const tuiRefresh = 500 * time.Millisecond
+
+// the dashboard's panels, which are also the fields its view can be filtered on
+const (
+	tuiStatus = iota
+	tuiIP
+	tuiPath
+	tuiUA
+	tuiFields
+)
+
+var tuiFieldNames = [tuiFields]string{"status", "ip", "path", "user-agent"}
+
+// sparkBlocks draw the requests/sec sparkline, lowest first
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkBuckets are the bucket sizes the sparkline picks from, so that it always spans the whole view
+var sparkBuckets = []time.Duration{
+	time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute, 5 * time.Minute,
+	15 * time.Minute, time.Hour, 6 * time.Hour, 24 * time.Hour, 7 * 24 * time.Hour,
+}
+
+// tuiRecord is what the dashboard keeps of each line, with its strings interned
+type tuiRecord struct {
+	time   int64
+	values [tuiFields]uint32
+}
+
+// tuiFilter is one drill-down step: only lines whose field has this value
+type tuiFilter struct {
+	field int
+	value uint32
+}
+
+// tuiView is what the dashboard shows: the counts of the lines that pass the filters
+type tuiView struct {
+	total     int
+	counts    [tuiFields]map[uint32]int
+	perSecond map[int64]int
+	first     int64
+	last      int64
+}
+
+func newTUIView() *tuiView {
+	v := &tuiView{perSecond: map[int64]int{}}
+	for i := range v.counts {
+		v.counts[i] = map[uint32]int{}
+	}
+	return v
+}
+
+func (v *tuiView) add(r tuiRecord) {
+	v.total++
+	for i, value := range r.values {
+		v.counts[i][value]++
+	}
+	if r.time != 0 {
+		v.perSecond[r.time]++
+		if v.first == 0 || r.time < v.first {
+			v.first = r.time
+		}
+		if r.time > v.last {
+			v.last = r.time
+		}
+	}
+}
+
+// remove takes back a record that was added
+func (v *tuiView) remove(r tuiRecord) {
+	v.total--
+	for i, value := range r.values {
+		if v.counts[i][value]--; v.counts[i][value] == 0 {
+			delete(v.counts[i], value)
+		}
+	}
+	if r.time == 0 {
+		return
+	}
+	if v.perSecond[r.time]--; v.perSecond[r.time] > 0 {
+		return
+	}
+	delete(v.perSecond, r.time)
+	if r.time == v.first || r.time == v.last {
+		v.first, v.last = 0, 0
+		for t := range v.perSecond {
+			if v.first == 0 || t < v.first {
+				v.first = t
+			}
+			if t > v.last {
+				v.last = t
+			}
+		}
+	}
+}
+
+// dashboard is an interactive summary of a log, redrawn as lines arrive
+type dashboard struct {
+	mu sync.Mutex
+
+	name     string
+	follow   bool
+	template bool
+	term     *terminal
+
+	strings []string
+	ids     map[string]uint32
+	refs    []int    // how many kept records use each string
+	free    []uint32 // IDs of strings no longer used, to reuse
+
+	// keep is how many of the latest records are kept, or 0 for all; once there are that many, each new
+	// one replaces the oldest, at records[oldest]
+	keep    int
+	records []tuiRecord
+	oldest  int
+	lines   int
+	errors  int
+
+	filters  []tuiFilter
+	view     *tuiView
+	focus    int
+	selected [tuiFields]int
+
+	// done is set once the input has been read to the end
+	done bool
+
+	redraw chan struct{}
+	quit   chan struct{}
+	once   sync.Once
+}
+
+func newDashboard(name string, follow bool, template bool, keep int) *dashboard {
+	d := &dashboard{
+		name:     name,
+		follow:   follow,
+		template: template,
+		ids:      map[string]uint32{},
+		keep:     keep,
+		view:     newTUIView(),
+		redraw:   make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
+	d.intern("-")
+	return d
+}
+
+// intern returns the ID of s, adding it if it's new
+func (d *dashboard) intern(s string) uint32 {
+	if id, ok := d.ids[s]; ok {
+		return id
+	}
+	var id uint32
+	if n := len(d.free); n > 0 {
+		id = d.free[n-1]
+		d.free = d.free[:n-1]
+		d.strings[id] = s
+	} else {
+		id = uint32(len(d.strings))
+		d.strings = append(d.strings, s)
+		d.refs = append(d.refs, 0)
+	}
+	d.ids[s] = id
+	return id
+}
+
+// release drops a reference to a string, freeing it once nothing uses it. "-" and the values filtered on
+// are kept, since the filters and header still show them.
+func (d *dashboard) release(id uint32) {
+	if d.refs[id]--; d.refs[id] > 0 || id == 0 {
+		return
+	}
+	for _, f := range d.filters {
+		if f.value == id {
+			return
+		}
+	}
+	delete(d.ids, d.strings[id])
+	d.strings[id] = ""
+	d.free = append(d.free, id)
+}
+
+// start takes over the terminal and begins drawing and reading keys
+func (d *dashboard) start() error {
+	term, err := openTerminal()
+	if err != nil {
+		return err
+	}
+	d.term = term
+
+	// Ctrl-C and friends should leave the terminal usable
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		d.stop()
+	}()
+	go d.readKeys()
+	go d.drawLoop()
+	// quitting doesn't wait for the rest of the input to be read
+	go func() {
+		<-d.quit
+		d.mu.Lock()
+		d.term.restore()
+		os.Exit(0)
+	}()
+	return nil
+}
+
+// stop quits; it's safe to call more than once
+func (d *dashboard) stop() {
+	d.once.Do(func() { close(d.quit) })
+}
+
+// wait keeps the dashboard up once the input has been read, until the user quits
+func (d *dashboard) wait() {
+	d.mu.Lock()
+	d.done = true
+	d.mu.Unlock()
+	d.requestRedraw()
+	<-d.quit
+	// the quitting goroutine exits once it has the terminal back
+	select {}
+}
+
+func (d *dashboard) requestRedraw() {
+	select {
+	case d.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// add records a line
+func (d *dashboard) add(ll *LogLine) {
+	r := tuiRecord{}
+	if !ll.Time.IsZero() {
+		r.time = ll.Time.Unix()
+	}
+
+	status, ip, path, ua := "-", "-", "-", "-"
+	if ll.Status != 0 {
+		status = strconv.FormatInt(ll.Status, 10)
+	}
+	if ll.IP != nil {
+		ip = ll.IP.String()
+	}
+	if d.template {
+		path = requestRoute(ll)
+	} else {
+		path = sigmaURIStem(ll)
+	}
+	if path == "" {
+		path = "-"
+	}
+	if ll.UserAgent != "" {
+		ua = ll.UserAgent
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r.values = [tuiFields]uint32{d.intern(status), d.intern(ip), d.intern(path), d.intern(ua)}
+	for _, id := range r.values {
+		d.refs[id]++
+	}
+	d.lines++
+	if d.keep > 0 && len(d.records) == d.keep {
+		d.evict(d.records[d.oldest])
+		d.records[d.oldest] = r
+		d.oldest = (d.oldest + 1) % d.keep
+	} else {
+		d.records = append(d.records, r)
+	}
+	if d.matches(r) {
+		d.view.add(r)
+	}
+}
+
+// evict forgets the oldest record to make room for a new one
+func (d *dashboard) evict(r tuiRecord) {
+	if d.matches(r) {
+		d.view.remove(r)
+	}
+	for _, id := range r.values {
+		d.release(id)
+	}
+}
+
+// addError counts a line that couldn't be read or parsed, since there's nowhere to print it
+func (d *dashboard) addError(error) {
+	d.mu.Lock()
+	d.errors++
+	d.mu.Unlock()
+}
+
+func (d *dashboard) matches(r tuiRecord) bool {
+	for _, f := range d.filters {
+		if r.values[f.field] != f.value {
+			return false
+		}
+	}
+	return true
+}
+
+// refilter rebuilds the view after the filters change
+func (d *dashboard) refilter() {
+	d.view = newTUIView()
+	for _, r := range d.records {
+		if d.matches(r) {
+			d.view.add(r)
+		}
+	}
+	d.selected = [tuiFields]int{}
+}
+
+func (d *dashboard) readKeys() {
+	for {
+		key, err := d.term.readKey()
+		if err != nil {
+			d.stop()
+			return
+		}
+
+		d.mu.Lock()
+		switch key {
+		case "q", "Q", "\x1b":
+			d.mu.Unlock()
+			d.stop()
+			return
+		case "tab", "right", "l":
+			d.focus = (d.focus + 1) % tuiFields
+		case "backtab", "left", "h":
+			d.focus = (d.focus + tuiFields - 1) % tuiFields
+		case "down", "j":
+			d.selected[d.focus]++
+		case "up", "k":
+			if d.selected[d.focus] > 0 {
+				d.selected[d.focus]--
+			}
+		case "enter":
+			if top := d.top(d.focus, d.selected[d.focus]+1); d.selected[d.focus] < len(top) {
+				d.drill(d.focus, top[d.selected[d.focus]].id)
+			}
+		case "backspace", "u":
+			if len(d.filters) > 0 {
+				d.filters = d.filters[:len(d.filters)-1]
+				d.refilter()
+			}
+		case "c":
+			d.filters = nil
+			d.refilter()
+		}
+		d.mu.Unlock()
+		d.requestRedraw()
+	}
+}
+
+// drill narrows the view to lines whose field has value, replacing any filter already on that field
+func (d *dashboard) drill(field int, value uint32) {
+	filters := d.filters[:0:0]
+	for _, f := range d.filters {
+		if f.field != field {
+			filters = append(filters, f)
+		}
+	}
+	d.filters = append(filters, tuiFilter{field, value})
+	d.refilter()
+}
+
+func (d *dashboard) drawLoop() {
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+		case <-d.redraw:
+		}
+		width, height := d.term.size()
+		d.mu.Lock()
+		screen := d.render(width, height)
+		select {
+		case <-d.quit:
+		default:
+			fmt.Fprint(d.term.tty, screen)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// tuiEntry is one row of a panel
+type tuiEntry struct {
+	id    uint32
+	count int
+}
+
+// before reports whether a is listed above b: more common first, then alphabetically
+func (d *dashboard) before(a tuiEntry, b tuiEntry) bool {
+	if a.count != b.count {
+		return a.count > b.count
+	}
+	return d.strings[a.id] < d.strings[b.id]
+}
+
+// tuiHeap is a container/heap of the rows a panel will show, last row first, so that it only has to
+// sort as many rows as fit rather than every value seen
+type tuiHeap struct {
+	d       *dashboard
+	entries []tuiEntry
+}
+
+func (h *tuiHeap) Len() int           { return len(h.entries) }
+func (h *tuiHeap) Less(i, j int) bool { return h.d.before(h.entries[j], h.entries[i]) }
+func (h *tuiHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *tuiHeap) Push(x interface{}) { h.entries = append(h.entries, x.(tuiEntry)) }
+func (h *tuiHeap) Pop() interface{} {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return e
+}
+
+// top returns the n most common values of field in the view
+func (d *dashboard) top(field int, n int) []tuiEntry {
+	if n <= 0 {
+		return nil
+	}
+	h := &tuiHeap{d: d, entries: make([]tuiEntry, 0, n)}
+	for id, count := range d.view.counts[field] {
+		e := tuiEntry{id, count}
+		switch {
+		case h.Len() < n:
+			heap.Push(h, e)
+		case d.before(e, h.entries[0]):
+			h.entries[0] = e
+			heap.Fix(h, 0)
+		}
+	}
+	sort.Slice(h.entries, func(i, j int) bool { return d.before(h.entries[i], h.entries[j]) })
+	return h.entries
+}
+
+// render draws the whole screen: a header, the filters, the sparkline, then the panels in a 2x2 grid
+func (d *dashboard) render(width int, height int) string {
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	line := func(s string) {
+		b.WriteString(s)
+		b.WriteString("\x1b[K\r\n")
+	}
+
+	mode := "  reading"
+	switch {
+	case d.follow:
+		mode = "  following"
+	case d.done:
+		mode = ""
+	}
+	header := fmt.Sprintf(" axe  %s%s  %d lines", d.name, mode, d.lines)
+	if d.lines > len(d.records) {
+		header += fmt.Sprintf("  latest %d kept", len(d.records))
+	}
+	header += fmt.Sprintf("  %d shown  %d errors", d.view.total, d.errors)
+	if d.view.first != 0 {
+		header += fmt.Sprintf("  %s to %s", tuiTime(d.view.first), tuiTime(d.view.last))
+	}
+	line("\x1b[7m" + fit(header, width) + "\x1b[0m")
+
+	filters := " filter: none"
+	if len(d.filters) > 0 {
+		parts := make([]string, len(d.filters))
+		for i, f := range d.filters {
+			parts[i] = tuiFieldNames[f.field] + "=" + d.strings[f.value]
+		}
+		filters = " filter: " + strings.Join(parts, " > ")
+	}
+	line(fit(filters, width))
+
+	bucket, counts := d.sparkline(width - 2)
+	peak := 0
+	for _, c := range counts {
+		if c > peak {
+			peak = c
+		}
+	}
+	line(fit(fmt.Sprintf(" requests per %s, peak %d (%s/s)", shortDuration(bucket), peak, tuiRate(peak, bucket)), width))
+	line(" " + sparkString(counts, peak))
+	line("")
+
+	// leave the last line for the key help
+	panelHeight := (height - 6) / 2
+	if panelHeight < 3 {
+		panelHeight = 3
+	}
+	colWidth := width / 2
+	for row := 0; row < 2; row++ {
+		left := d.panel(row*2, colWidth-1, panelHeight)
+		right := d.panel(row*2+1, width-colWidth, panelHeight)
+		for i := range left {
+			line(left[i] + " " + right[i])
+		}
+	}
+
+	b.WriteString(fit(" tab: next panel  up/down: select  enter: filter on it  backspace: undo  c: clear  q: quit", width))
+	b.WriteString("\x1b[K\x1b[J")
+	return b.String()
+}
+
+// panel draws the lines of one panel, padded to width
+func (d *dashboard) panel(field int, width int, height int) []string {
+	lines := make([]string, 0, height)
+	title := fmt.Sprintf(" %s (%d)", tuiFieldNames[field], len(d.view.counts[field]))
+	if field == d.focus {
+		lines = append(lines, "\x1b[1;4m"+pad(title, width)+"\x1b[0m")
+	} else {
+		lines = append(lines, "\x1b[1m"+pad(title, width)+"\x1b[0m")
+	}
+
+	rows := height - 1
+	// keep the selection on screen, and in range as the counts change
+	if n := len(d.view.counts[field]); d.selected[field] >= n && n > 0 {
+		d.selected[field] = n - 1
+	}
+	start := 0
+	if d.selected[field] >= rows {
+		start = d.selected[field] - rows + 1
+	}
+	top := d.top(field, start+rows)
+	for i := start; i < start+rows; i++ {
+		if i >= len(top) {
+			lines = append(lines, pad("", width))
+			continue
+		}
+		e := top[i]
+		pct := 0.0
+		if d.view.total > 0 {
+			pct = float64(e.count) * 100 / float64(d.view.total)
+		}
+		text := pad(fmt.Sprintf(" %8d %5.1f%% %s", e.count, pct, d.strings[e.id]), width)
+		if field == tuiStatus {
+			text = statusColor(d.strings[e.id]) + text + "\x1b[0m"
+		}
+		if field == d.focus && i == d.selected[field] {
+			text = "\x1b[7m" + text + "\x1b[0m"
+		}
+		lines = append(lines, text)
+	}
+	return lines
+}
+
+// sparkline buckets the view's lines by time into n buckets, ending at the last line, choosing the smallest
+// bucket size that covers everything
+func (d *dashboard) sparkline(n int) (time.Duration, []int) {
+	if n < 1 {
+		n = 1
+	}
+	bucket := sparkBuckets[len(sparkBuckets)-1]
+	span := time.Duration(d.view.last-d.view.first+1) * time.Second
+	for _, b := range sparkBuckets {
+		if time.Duration(n)*b >= span {
+			bucket = b
+			break
+		}
+	}
+
+	counts := make([]int, n)
+	secs := int64(bucket / time.Second)
+	end := d.view.last - d.view.last%secs + secs
+	for t, c := range d.view.perSecond {
+		i := n - 1 - int((end-1-t)/secs)
+		if i >= 0 && i < n {
+			counts[i] += c
+		}
+	}
+	return bucket, counts
+}
+
+func sparkString(counts []int, peak int) string {
+	var b strings.Builder
+	for _, c := range counts {
+		switch {
+		case c == 0:
+			b.WriteRune(' ')
+		case peak == 0:
+			b.WriteRune(sparkBlocks[0])
+		default:
+			b.WriteRune(sparkBlocks[(c*(len(sparkBlocks)-1)+peak-1)/peak])
+		}
+	}
+	return b.String()
+}
+
+// tuiRate formats a bucket's count as requests per second, to two significant figures below 10
+func tuiRate(count int, bucket time.Duration) string {
+	rate := float64(count) / bucket.Seconds()
+	if rate >= 10 || rate == 0 {
+		return strconv.Itoa(int(rate + 0.5))
+	}
+	return strconv.FormatFloat(rate, 'g', 2, 64)
+}
+
+// shortDuration formats d without zero minutes and seconds, e.g. 1h rather than 1h0m0s
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+func tuiTime(t int64) string {
+	return time.Unix(t, 0).UTC().Format("2006-01-02 15:04:05")
+}
+
+// statusColor colors statuses by class: green for success, cyan for redirects, yellow for client errors
+// and red for server errors
+func statusColor(status string) string {
+	switch {
+	case strings.HasPrefix(status, "2"):
+		return "\x1b[32m"
+	case strings.HasPrefix(status, "3"):
+		return "\x1b[36m"
+	case strings.HasPrefix(status, "4"):
+		return "\x1b[33m"
+	case strings.HasPrefix(status, "5"):
+		return "\x1b[31m"
+	}
+	return ""
+}
+
+// fit cuts s down to width characters
+func fit(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:width])
+}
+
+// pad fits s to exactly width characters
+func pad(s string, width int) string {
+	s = fit(strings.Map(func(r rune) rune {
+		if r < ' ' {
+			return ' '
+		}
+		return r
+	}, s), width)
+	if n := utf8.RuneCountInString(s); n < width {
+		s += strings.Repeat(" ", width-n)
+	}
+	return s
+}
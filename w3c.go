@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// w3cDefaultFields is the field order IIS uses when no #Fields directive has been seen
+var w3cDefaultFields = []string{
+	"date", "time", "s-ip", "cs-method", "cs-uri-stem", "cs-uri-query", "s-port", "cs-username",
+	"c-ip", "cs(User-Agent)", "cs(Referer)", "sc-status", "sc-substatus", "sc-win32-status", "time-taken",
+}
+
+// w3cFieldParsers maps W3C extended log field identifiers to the *ItemParser that handles them; anything
+// not listed here is ignored
+var w3cFieldParsers = map[string]*ItemParser{
+	"date":           ParserW3CDate,
+	"time":           ParserW3CClock,
+	"c-ip":           ParserW3CIP,
+	"cs-username":    ParserW3CUser,
+	"cs-method":      ParserW3CMethod,
+	"cs-uri-stem":    ParserW3CURIStem,
+	"cs-uri-query":   ParserW3CURIQuery,
+	"cs-version":     ParserW3CProto,
+	"cs-host":        ParserW3CHost,
+	"cs(host)":       ParserW3CHost,
+	"sc-status":      ParserW3CStatus,
+	"sc-bytes":       ParserW3CBodyBytes,
+	"time-taken":     ParserW3CTimeTaken,
+	"cs(user-agent)": ParserW3CUserAgent,
+	"cs(referer)":    ParserW3CReferer,
+	"cs(referrer)":   ParserW3CReferer,
+
+	"cs(x-forwarded-for)": ParserW3CForwardedFor,
+	"cs(forwarded)":       ParserW3CForwardedFor,
+	"x-forwarded-for":     ParserW3CForwardedFor,
+}
+
+const (
+	w3cDateFormat  = "2006-01-02"
+	w3cClockFormat = "15:04:05"
+)
+
+// w3cItemOrder returns the []*ItemParser matching the supplied W3C field identifiers
+func w3cItemOrder(fields []string) []*ItemParser {
+	order := make([]*ItemParser, 0, len(fields))
+	for _, field := range fields {
+		if ip, ok := w3cFieldParsers[strings.ToLower(field)]; ok {
+			order = append(order, ip)
+		} else {
+			order = append(order, ParserW3CIgnore)
+		}
+	}
+	return order
+}
+
+// W3CParser parses W3C extended log format lines (IIS, various CDNs), rebuilding its *Parser whenever a
+// #Fields directive changes the column order
+type W3CParser struct {
+	parser     *Parser
+	directives []string
+}
+
+// NewW3CParser returns a *W3CParser expecting the IIS default fields until told otherwise
+func NewW3CParser() *W3CParser {
+	w := &W3CParser{}
+	w.setFields(w3cDefaultFields)
+	return w
+}
+
+func (w *W3CParser) setFields(fields []string) {
+	w.parser = NewParser(w3cItemOrder(fields))
+}
+
+// ParseLine handles directive lines itself, returning a nil *LogLine for them, and hands everything else
+// to the *Parser built from the most recent #Fields directive
+func (w *W3CParser) ParseLine(input string) (*LogLine, error) {
+	input = strings.TrimRight(input, "\r")
+	if strings.HasPrefix(input, "#") {
+		if strings.HasPrefix(input, "#Fields:") {
+			w.setFields(strings.Fields(strings.TrimPrefix(input, "#Fields:")))
+		}
+		w.directives = append(w.directives, input)
+		return nil, nil
+	}
+	ll, err := w.parser.ParseLine(input)
+	if ll != nil {
+		ll.directives, w.directives = w.directives, nil
+	}
+	return ll, err
+}
+
+// ParserW3CDate takes a field item and produces a time.Time holding only the date
+var ParserW3CDate = &ItemParser{
+	valueType: ValueDate,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseW3CDate,
+}
+
+func parseW3CDate(input ...item) (value, error) {
+	d, err := time.Parse(w3cDateFormat, input[0].val)
+	if err != nil {
+		return nilVal(input), err
+	}
+	return value{input, d, ValueDate}, nil
+}
+
+// ParserW3CClock takes a field item and produces a time.Time holding only the time of day
+var ParserW3CClock = &ItemParser{
+	valueType: ValueClock,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseW3CClock,
+}
+
+func parseW3CClock(input ...item) (value, error) {
+	// some servers log fractional seconds; the layout below accepts them
+	c, err := time.Parse(w3cClockFormat, input[0].val)
+	if err != nil {
+		return nilVal(input), err
+	}
+	return value{input, c, ValueClock}, nil
+}
+
+// ParserW3CIgnore takes a field item and suppresses its addition
+var ParserW3CIgnore = &ItemParser{
+	valueType: ValueIgnore,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   nil,
+}
+
+// ParserW3CIP takes a field item and produces a net.IP; unlike ParserIP, it accepts IPv6 addresses
+var ParserW3CIP = &ItemParser{
+	valueType: ValueIP,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseIP,
+}
+
+// ParserW3CUser takes a field item and produces a string
+var ParserW3CUser = &ItemParser{
+	valueType: ValueUser,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseUser,
+}
+
+// ParserW3CMethod takes a field item and produces a string
+var ParserW3CMethod = &ItemParser{
+	valueType: ValueMethod,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseW3CMethod,
+}
+
+func parseW3CMethod(input ...item) (value, error) {
+	return value{input, input[0].val, ValueMethod}, nil
+}
+
+// ParserW3CURIStem takes a field item and produces a string
+var ParserW3CURIStem = &ItemParser{
+	valueType: ValueURIStem,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseW3CURIStem,
+}
+
+func parseW3CURIStem(input ...item) (value, error) {
+	path, err := url.PathUnescape(input[0].val)
+	if err != nil {
+		return nilVal(input), err
+	}
+	return value{input, path, ValueURIStem}, nil
+}
+
+// ParserW3CURIQuery takes a field item and produces a string
+var ParserW3CURIQuery = &ItemParser{
+	valueType: ValueURIQuery,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseW3CURIQuery,
+}
+
+func parseW3CURIQuery(input ...item) (value, error) {
+	if input[0].val == "-" {
+		return nilVal(input), nil
+	}
+	return value{input, input[0].val, ValueURIQuery}, nil
+}
+
+// ParserW3CProto takes a field item and produces an *http.Request holding only the HTTP version
+var ParserW3CProto = &ItemParser{
+	valueType: ValueProto,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseW3CProto,
+}
+
+func parseW3CProto(input ...item) (value, error) {
+	if input[0].val == "-" {
+		return nilVal(input), nil
+	}
+	maj, min, ok := http.ParseHTTPVersion(input[0].val)
+	if !ok {
+		return nilVal(input), fmt.Errorf("invalid HTTP version")
+	}
+	req := &http.Request{ProtoMajor: maj, ProtoMinor: min, Proto: input[0].val}
+	return value{input, req, ValueProto}, nil
+}
+
+// ParserW3CHost takes a field item and produces a string
+var ParserW3CHost = &ItemParser{
+	valueType: ValueHost,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseW3CHost,
+}
+
+func parseW3CHost(input ...item) (value, error) {
+	if input[0].val == "-" {
+		return nilVal(input), nil
+	}
+	return value{input, input[0].val, ValueHost}, nil
+}
+
+// ParserW3CStatus takes a field item and produces an int64
+var ParserW3CStatus = &ItemParser{
+	valueType: ValueStatus,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseStatus,
+}
+
+// ParserW3CBodyBytes takes a field item and produces an int64
+var ParserW3CBodyBytes = &ItemParser{
+	valueType: ValueBodyBytes,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseW3CBodyBytes,
+}
+
+func parseW3CBodyBytes(input ...item) (value, error) {
+	if input[0].val == "-" {
+		return nilVal(input), nil
+	}
+	return parseBodyBytes(input...)
+}
+
+// ParserW3CTimeTaken takes a field item and produces a time.Duration
+var ParserW3CTimeTaken = &ItemParser{
+	valueType: ValueRequestTime,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseW3CTimeTaken,
+}
+
+// parseW3CTimeTaken reads IIS-style integer milliseconds, or spec-style fractional seconds
+func parseW3CTimeTaken(input ...item) (value, error) {
+	str := input[0].val
+	if str == "-" {
+		return nilVal(input), nil
+	}
+	if strings.Contains(str, ".") {
+		secs, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return nilVal(input), err
+		}
+		return value{input, time.Duration(secs * float64(time.Second)), ValueRequestTime}, nil
+	}
+	ms, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return nilVal(input), err
+	}
+	return value{input, time.Duration(ms) * time.Millisecond, ValueRequestTime}, nil
+}
+
+// ParserW3CUserAgent takes a field item and produces a string, restoring the spaces IIS replaces with '+'
+var ParserW3CUserAgent = &ItemParser{
+	valueType: ValueUserAgent,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseW3CUserAgent,
+}
+
+func parseW3CUserAgent(input ...item) (value, error) {
+	if input[0].val == "-" {
+		return nilVal(input), nil
+	}
+	ua := strings.Replace(input[0].val, "+", " ", -1)
+	return value{input, ua, ValueUserAgent}, nil
+}
+
+// ParserW3CReferer takes a field item and produces a *url.URL
+var ParserW3CReferer = &ItemParser{
+	valueType: ValueReferer,
+	producers: []itemProducer{fieldProducer},
+	parseFn:   parseReferer,
+}
@@ -0,0 +1,75 @@
+package main
+
+import "time"
+
+// pruneEvery is how many events slidingWindow takes between sweeps for idle keys
+const pruneEvery = 10000
+
+// slidingWindow counts events per key over the most recent window of log time (not wall-clock time), so
+// that it gives the same answers reading an old file as it does following a live one
+type slidingWindow struct {
+	window time.Duration
+	events map[string][]time.Time
+	latest time.Time
+	adds   int
+}
+
+func newSlidingWindow(window time.Duration) *slidingWindow {
+	return &slidingWindow{window: window, events: map[string][]time.Time{}}
+}
+
+// add records an event for key at t and returns how many events key has had within the window ending at its
+// latest one
+func (w *slidingWindow) add(key string, t time.Time) int {
+	// servers log requests as they finish, so a slow one can come after later ones; keep events in time
+	// order so that evict can drop from the front
+	events := w.events[key]
+	i := len(events)
+	for i > 0 && events[i-1].After(t) {
+		i--
+	}
+	events = append(events, time.Time{})
+	copy(events[i+1:], events[i:])
+	events[i] = t
+	w.events[key] = w.evict(events, events[len(events)-1])
+
+	if t.After(w.latest) {
+		w.latest = t
+	}
+	w.adds++
+	if w.adds%pruneEvery == 0 {
+		w.prune()
+	}
+
+	return len(w.events[key])
+}
+
+// last returns the time of key's latest event still kept, or the zero time if it has none
+func (w *slidingWindow) last(key string) time.Time {
+	if events := w.events[key]; len(events) > 0 {
+		return events[len(events)-1]
+	}
+	return time.Time{}
+}
+
+// evict drops events, which are in time order, that fell out of the window ending at t; lines that are
+// slightly out of order are kept as long as they're still inside the window
+func (w *slidingWindow) evict(events []time.Time, t time.Time) []time.Time {
+	cutoff := t.Add(-w.window)
+	i := 0
+	for i < len(events) && !events[i].After(cutoff) {
+		i++
+	}
+	return events[i:]
+}
+
+// prune forgets keys with no events inside the window ending at the latest time seen
+func (w *slidingWindow) prune() {
+	for key, events := range w.events {
+		if events = w.evict(events, w.latest); len(events) == 0 {
+			delete(w.events, key)
+		} else {
+			w.events[key] = events
+		}
+	}
+}
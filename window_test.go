@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlidingWindowOutOfOrder(t *testing.T) {
+	start := time.Date(2023, 10, 10, 13, 0, 0, 0, time.UTC)
+	w := newSlidingWindow(time.Minute)
+	tests := []struct {
+		at   int // seconds after start
+		want int
+	}{
+		{100, 1},
+		// logged late, and already outside the window ending at 100
+		{30, 1},
+		{150, 2},
+		// logged late, but inside the window ending at 150
+		{120, 3},
+		{200, 2},
+	}
+	for _, test := range tests {
+		if got := w.add("k", start.Add(time.Duration(test.at)*time.Second)); got != test.want {
+			t.Errorf("add at %ds: %d in window, want %d", test.at, got, test.want)
+		}
+	}
+}
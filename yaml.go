@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// This is a deliberately small YAML reader - enough for Sigma rules and similar hand-written config:
+// block mappings and sequences, plain/quoted scalars, simple flow collections, block scalars (| and >),
+// comments, and multiple documents separated by "---". Mappings decode to map[string]interface{},
+// sequences to []interface{}, and every scalar to a string; a key with no value decodes to nil.
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string // without indentation or trailing comment
+	raw    string // without trailing newline, for block scalars
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseYAMLDocuments parses every document in input
+func parseYAMLDocuments(input string) ([]interface{}, error) {
+	var docs []interface{}
+	var current []yamlLine
+
+	flush := func() error {
+		if len(current) == 0 {
+			return nil
+		}
+		p := &yamlParser{lines: current}
+		doc, err := p.parseNode(current[0].indent)
+		if err != nil {
+			return err
+		}
+		if p.pos < len(p.lines) {
+			return fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].num)
+		}
+		docs = append(docs, doc)
+		current = nil
+		return nil
+	}
+
+	for i, raw := range strings.Split(strings.Replace(input, "\r\n", "\n", -1), "\n") {
+		if strings.HasPrefix(raw, "---") || strings.HasPrefix(raw, "...") {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if strings.ContainsRune(raw, '\t') && strings.TrimLeft(raw, " \t") != strings.TrimLeft(raw, " ") {
+			return nil, fmt.Errorf("line %d: tabs can't be used for indentation", i+1)
+		}
+		text := strings.TrimLeft(raw, " ")
+		current = append(current, yamlLine{
+			num:    i + 1,
+			indent: len(raw) - len(text),
+			text:   strings.TrimRight(stripYAMLComment(text), " "),
+			raw:    raw,
+		})
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	return docs, nil
+}
+
+// stripYAMLComment removes a trailing "# comment" that isn't inside quotes
+func stripYAMLComment(s string) string {
+	var quote rune
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '#' && (i == 0 || s[i-1] == ' '):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// skipBlank moves past lines with no content
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) && p.lines[p.pos].text == "" {
+		p.pos++
+	}
+}
+
+// parseNode parses whatever node starts at the current line, which must be indented by indent
+func (p *yamlParser) parseNode(indent int) (interface{}, error) {
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	line := p.lines[p.pos]
+	if line.text == "-" || strings.HasPrefix(line.text, "- ") {
+		return p.parseSequence(line.indent)
+	}
+	if _, _, ok := splitYAMLKey(line.text); ok {
+		return p.parseMapping(line.indent)
+	}
+	p.pos++
+	return parseYAMLScalar(line.text)
+}
+
+func (p *yamlParser) parseSequence(indent int) ([]interface{}, error) {
+	result := []interface{}{}
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.lines) {
+			return result, nil
+		}
+		line := p.lines[p.pos]
+		if line.indent != indent || !(line.text == "-" || strings.HasPrefix(line.text, "- ")) {
+			if line.indent > indent {
+				return nil, fmt.Errorf("line %d: unexpected indentation", line.num)
+			}
+			return result, nil
+		}
+
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if rest == "" {
+			// the item is a nested node on the following lines
+			p.pos++
+			p.skipBlank()
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				result = append(result, nil)
+				continue
+			}
+			node, err := p.parseNode(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, node)
+			continue
+		}
+
+		// "- key: value" starts a mapping whose other keys line up with "key"; rewrite the line so it
+		// looks like the first line of that mapping
+		p.lines[p.pos].indent = indent + len(line.text) - len(rest)
+		p.lines[p.pos].text = rest
+		node, err := p.parseNode(p.lines[p.pos].indent)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, node)
+	}
+}
+
+func (p *yamlParser) parseMapping(indent int) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.lines) {
+			return result, nil
+		}
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			return result, nil
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.num)
+		}
+
+		key, val, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", line.num)
+		}
+		p.pos++
+
+		switch {
+		case val == "|" || val == ">" || strings.HasPrefix(val, "|-") || strings.HasPrefix(val, ">-"):
+			result[key] = p.parseBlockScalar(indent, val)
+		case val != "":
+			scalar, err := parseYAMLScalar(val)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line.num, err)
+			}
+			result[key] = scalar
+		default:
+			// the value is a nested node, which may be a sequence at the same indentation as the key
+			p.skipBlank()
+			if p.pos >= len(p.lines) {
+				result[key] = nil
+				continue
+			}
+			next := p.lines[p.pos]
+			isSeq := next.text == "-" || strings.HasPrefix(next.text, "- ")
+			if next.indent > indent || (next.indent == indent && isSeq) {
+				node, err := p.parseNode(next.indent)
+				if err != nil {
+					return nil, err
+				}
+				result[key] = node
+			} else {
+				result[key] = nil
+			}
+		}
+	}
+}
+
+// parseBlockScalar collects the lines of a | or > scalar belonging to a key indented by indent
+func (p *yamlParser) parseBlockScalar(indent int, style string) string {
+	var lines []string
+	blockIndent := -1
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if strings.TrimSpace(line.raw) != "" {
+			if line.indent <= indent {
+				break
+			}
+			if blockIndent < 0 {
+				blockIndent = line.indent
+			}
+		}
+		if len(line.raw) > blockIndent && blockIndent >= 0 {
+			lines = append(lines, line.raw[blockIndent:])
+		} else {
+			lines = append(lines, "")
+		}
+		p.pos++
+	}
+
+	sep := "\n"
+	if strings.HasPrefix(style, ">") {
+		sep = " "
+	}
+	result := strings.Join(lines, sep)
+	result = strings.TrimRight(result, sep+"\n")
+	if !strings.HasSuffix(style, "-") {
+		result += "\n"
+	}
+	return result
+}
+
+// splitYAMLKey splits "key: value" or "key:", ignoring colons inside quotes
+func splitYAMLKey(s string) (key string, val string, ok bool) {
+	var quote rune
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			if i == 0 {
+				quote = r
+			}
+		case r == ':' && (i == len(s)-1 || s[i+1] == ' '):
+			key = strings.TrimSpace(s[:i])
+			if unquoted, err := parseYAMLScalar(key); err == nil {
+				if str, isStr := unquoted.(string); isStr {
+					key = str
+				}
+			}
+			return key, strings.TrimSpace(s[i+1:]), key != ""
+		case r == '[' || r == '{':
+			if i == 0 {
+				return "", "", false
+			}
+		}
+	}
+	return "", "", false
+}
+
+// parseYAMLScalar handles quoted and plain scalars, flow collections, and the null values
+func parseYAMLScalar(s string) (interface{}, error) {
+	switch {
+	case s == "~" || s == "null" || s == "Null" || s == "NULL":
+		return nil, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("unterminated string: %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case strings.HasPrefix(s, "\""):
+		if len(s) < 2 || !strings.HasSuffix(s, "\"") {
+			return nil, fmt.Errorf("unterminated string: %s", s)
+		}
+		return unescapeYAMLDouble(s[1 : len(s)-1]), nil
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated sequence: %s", s)
+		}
+		return parseYAMLFlowSequence(s[1 : len(s)-1])
+	case strings.HasPrefix(s, "{"):
+		if !strings.HasSuffix(s, "}") {
+			return nil, fmt.Errorf("unterminated mapping: %s", s)
+		}
+		return parseYAMLFlowMapping(s[1 : len(s)-1])
+	}
+	return s, nil
+}
+
+// parseYAMLFlowMapping parses the inside of {a: b, c: 'd'}
+func parseYAMLFlowMapping(s string) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+	for _, part := range splitYAMLFlow(s) {
+		key, val, ok := splitYAMLKey(part)
+		if !ok {
+			return nil, fmt.Errorf("expected key: value: %s", part)
+		}
+		v, err := parseYAMLScalar(val)
+		if err != nil {
+			return nil, err
+		}
+		if val == "" {
+			v = nil
+		}
+		result[key] = v
+	}
+	return result, nil
+}
+
+// splitYAMLFlow splits a flow collection's contents on commas outside quotes
+func splitYAMLFlow(s string) []string {
+	var parts []string
+	var quote rune
+	start := 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == ',':
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, s[start:])
+
+	result := parts[:0]
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			result = append(result, part)
+		}
+	}
+	return result
+}
+
+// parseYAMLFlowSequence parses the inside of [a, 'b', "c"]
+func parseYAMLFlowSequence(s string) ([]interface{}, error) {
+	result := []interface{}{}
+	for _, part := range splitYAMLFlow(s) {
+		v, err := parseYAMLScalar(part)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+// unescapeYAMLDouble handles the escapes that show up in practice in double-quoted scalars
+func unescapeYAMLDouble(s string) string {
+	if !strings.ContainsRune(s, '\\') {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '0':
+			b.WriteByte(0)
+		case 'x':
+			if i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+				b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+				i += 2
+			} else {
+				b.WriteString(`\x`)
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}